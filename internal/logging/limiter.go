@@ -0,0 +1,78 @@
+// Package logging keeps per-request agent diagnostics from flooding the
+// host application's logs.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how long a Limiter waits before letting the same event
+// through again.
+const DefaultInterval = 10 * time.Second
+
+// Limiter lets one log event per message through per interval and counts
+// the ones it holds back. The zero value uses DefaultInterval.
+type Limiter struct {
+	// Interval overrides DefaultInterval when positive.
+	Interval time.Duration
+
+	mu     sync.Mutex
+	events map[string]*window
+	now    func() time.Time
+}
+
+type window struct {
+	until      time.Time
+	suppressed int
+}
+
+// Log emits msg on logger unless the same msg was emitted within the
+// interval. The next event that gets through carries a "suppressed"
+// attribute with the number of events dropped in between.
+func (l *Limiter) Log(ctx context.Context, logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	if logger == nil || !logger.Enabled(ctx, level) {
+		return
+	}
+	suppressed, ok := l.allow(msg)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Log(ctx, level, msg, args...)
+}
+
+// allow reports whether msg may be logged now, and how many events with the
+// same msg were dropped since it was last logged.
+func (l *Limiter) allow(msg string) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	interval := l.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	if l.events == nil {
+		l.events = make(map[string]*window)
+	}
+	w := l.events[msg]
+	if w == nil {
+		w = &window{}
+		l.events[msg] = w
+	}
+	if now.Before(w.until) {
+		w.suppressed++
+		return 0, false
+	}
+	suppressed := w.suppressed
+	w.until = now.Add(interval)
+	w.suppressed = 0
+	return suppressed, true
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_SuppressesRepeatsWithinInterval(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	now := time.Unix(0, 0)
+	l := &Limiter{Interval: time.Second, now: func() time.Time { return now }}
+
+	for i := 0; i < 3; i++ {
+		l.Log(context.Background(), logger, slog.LevelWarn, "allocation failed", "route", "GET /a")
+	}
+	l.Log(context.Background(), logger, slog.LevelWarn, "fetch failed")
+	now = now.Add(time.Second)
+	l.Log(context.Background(), logger, slog.LevelWarn, "allocation failed", "route", "GET /b")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], `msg="allocation failed" route="GET /a"`)
+		assert.NotContains(t, lines[0], "suppressed")
+		assert.Contains(t, lines[1], `msg="fetch failed"`)
+		assert.Contains(t, lines[2], `route="GET /b" suppressed=2`)
+	}
+}
+
+func TestLimiter_SkipsDisabledLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	var l Limiter
+
+	l.Log(context.Background(), logger, slog.LevelInfo, "denied")
+	l.Log(context.Background(), logger, slog.LevelWarn, "denied")
+	l.Log(context.Background(), nil, slog.LevelWarn, "denied")
+
+	assert.Equal(t, 1, strings.Count(buf.String(), "msg=denied"))
+}
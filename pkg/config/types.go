@@ -69,6 +69,12 @@ type PolicyResponse struct {
 type Route struct {
 	Method string `json:"method"`
 	URL    string `json:"url"`
+	// Host limits the route to requests for one hostname, compared without
+	// the port and ignoring case. "*.example.com" matches any subdomain.
+	Host string `json:"host,omitempty"`
+	// Headers limits the route to requests carrying every listed header
+	// with the given value; "*" accepts any value.
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // VerifyResponse represents the response from the verification endpoint
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+)
+
+// latencyBudgets bounds how long a request may wait on UsageFlow before its
+// handler runs. Route budgets take precedence over the default.
+type latencyBudgets struct {
+	byRoute map[string]map[string]time.Duration
+	// rules holds budgets for wildcard and scoped routes, in the order they
+	// were set.
+	rules []budgetRule
+	all   time.Duration
+}
+
+type budgetRule struct {
+	method string
+	rule   routeRule
+	budget time.Duration
+}
+
+func (b *latencyBudgets) set(budget time.Duration, routes []config.Route) {
+	if len(routes) == 0 {
+		b.all = budget
+		return
+	}
+	if b.byRoute == nil {
+		b.byRoute = make(map[string]map[string]time.Duration)
+	}
+	for _, route := range routes {
+		if route.Method == "" || route.URL == "" {
+			continue
+		}
+		if isScopedRoute(route) || isRoutePattern(route.URL) {
+			b.rules = append(b.rules, budgetRule{route.Method, compileRouteRule(route), budget})
+			continue
+		}
+		if _, ok := b.byRoute[route.Method]; !ok {
+			b.byRoute[route.Method] = make(map[string]time.Duration)
+		}
+		b.byRoute[route.Method][route.URL] = budget
+	}
+}
+
+// lookup returns the budget for a request to the route url. Scoped routes
+// come first, then exact routes, then wildcards. req may be nil, in which
+// case scoped routes are skipped.
+func (b *latencyBudgets) lookup(req *http.Request, method, url string) time.Duration {
+	var segments []string
+	if len(b.rules) > 0 {
+		segments = routeSegments(url)
+	}
+	for _, r := range b.rules {
+		if r.rule.scoped() && (r.method == method || r.method == "*") && r.rule.match(req, url, segments) {
+			return r.budget
+		}
+	}
+	for _, m := range []string{method, "*"} {
+		if urls, ok := b.byRoute[m]; ok {
+			if d, ok := urls[url]; ok {
+				return d
+			}
+			if d, ok := urls["*"]; ok {
+				return d
+			}
+		}
+	}
+	for _, r := range b.rules {
+		if !r.rule.scoped() && (r.method == method || r.method == "*") && r.rule.match(req, url, segments) {
+			return r.budget
+		}
+	}
+	return b.all
+}
+
+// budgetContext derives the context for pre-handler UsageFlow round trips:
+// ctx (the request context or a span started from it) bounded by the
+// route's latency budget, if any.
+func (u *UsageFlowAPI) budgetContext(ctx context.Context, req *http.Request, url string) (context.Context, context.CancelFunc) {
+	if budget := u.budgets.lookup(req, req.Method, url); budget > 0 {
+		return context.WithTimeout(ctx, budget)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+)
+
+func rateLimitedPolicy(method, url string) config.ApiConfigStrategy {
+	return config.ApiConfigStrategy{
+		Method:                method,
+		Url:                   url,
+		IdentityFieldName:     stringPtr("x-customer-id"),
+		IdentityFieldLocation: stringPtr("headers"),
+		HasRateLimit:          true,
+	}
+}
+
+func TestLatencyBudget_FailsOpenWhenExhausted(t *testing.T) {
+	manager := &fakeSocketManager{connected: true, blockAsync: true}
+	api := newTestAPI(manager, rateLimitedPolicy(http.MethodPost, "/search"))
+	api.budgets.set(20*time.Millisecond, []config.Route{{Method: http.MethodPost, URL: "/search"}})
+
+	handlerCalled := false
+	handler := api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerCalled = true
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/search", nil)
+	req.Header.Set("x-customer-id", "cust-1")
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, handlerCalled, "an exhausted budget lets the request through")
+	assert.Len(t, manager.asyncMessages, 1)
+	assert.True(t, api.connected, "a budget timeout is not treated as an outage")
+}
+
+func TestRequestContext_CancelStopsWaiting(t *testing.T) {
+	manager := &fakeSocketManager{connected: true, blockAsync: true}
+	api := newTestAPI(manager, rateLimitedPolicy(http.MethodPost, "/search"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/search", nil).WithContext(ctx)
+	req.Header.Set("x-customer-id", "cust-1")
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Len(t, manager.asyncMessages, 1)
+}
+
+func TestLatencyBudgets_Lookup(t *testing.T) {
+	var b latencyBudgets
+	assert.Zero(t, b.lookup(nil, http.MethodGet, "/a"))
+
+	b.set(time.Second, nil)
+	b.set(50*time.Millisecond, []config.Route{{Method: http.MethodGet, URL: "/fast"}})
+	b.set(200*time.Millisecond, []config.Route{{Method: "*", URL: "/any"}})
+
+	assert.Equal(t, 50*time.Millisecond, b.lookup(nil, http.MethodGet, "/fast"))
+	assert.Equal(t, 200*time.Millisecond, b.lookup(nil, http.MethodPost, "/any"))
+	assert.Equal(t, time.Second, b.lookup(nil, http.MethodPost, "/fast"))
+
+	b.set(100*time.Millisecond, []config.Route{{Method: http.MethodGet, URL: "/reports/*"}})
+	assert.Equal(t, 100*time.Millisecond, b.lookup(nil, http.MethodGet, "/reports/:id/pdf"))
+	assert.Equal(t, time.Second, b.lookup(nil, http.MethodGet, "/reports"))
+
+	b.set(10*time.Millisecond, []config.Route{{Method: "*", URL: "*", Host: "batch.example.com"}})
+	req := httptest.NewRequest(http.MethodGet, "http://batch.example.com/fast", nil)
+	assert.Equal(t, 10*time.Millisecond, b.lookup(req, http.MethodGet, "/fast"), "scoped routes come first")
+	assert.Equal(t, 50*time.Millisecond, b.lookup(nil, http.MethodGet, "/fast"))
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ChiInterceptor creates a chi middleware with the same metering behavior as
+// RequestInterceptor. The metered route is chi's route pattern (e.g.
+// "/orders/{id}"), so ledger IDs stay stable across concrete paths.
+//
+// Middlewares registered with Router.Use run before chi has matched the
+// route, so the pattern is resolved on demand by walking the routing tree
+// (including mounted subrouters) the same way chi will when it dispatches.
+func (u *UsageFlowAPI) ChiInterceptor() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u.interceptRequest(newHTTPRequest(w, r, next, chiRoute))
+		})
+	}
+}
+
+// chiRoute resolves the full chi route pattern and URL params for r.
+func chiRoute(r *http.Request) (string, map[string]string) {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return "", nil
+	}
+
+	// Inline middlewares (Router.With) run after chi matched the endpoint.
+	if n := len(rctx.RoutePatterns); n > 0 && !strings.HasSuffix(rctx.RoutePatterns[n-1], "/*") {
+		return rctx.RoutePattern(), chiParams(rctx)
+	}
+	if rctx.Routes == nil {
+		return "", nil
+	}
+
+	// rctx.Routes is always the top-level router, so matching the full path
+	// also walks mounted subrouters. Find mutates the context it is given, so
+	// match on a scratch one.
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	tctx := chi.NewRouteContext()
+	if rctx.Routes.Find(tctx, r.Method, path) == "" {
+		return "", nil
+	}
+	return tctx.RoutePattern(), chiParams(tctx)
+}
+
+func chiParams(rctx *chi.Context) map[string]string {
+	if len(rctx.URLParams.Keys) == 0 {
+		return nil
+	}
+	params := make(map[string]string, len(rctx.URLParams.Keys))
+	for i, key := range rctx.URLParams.Keys {
+		if key == "*" || i >= len(rctx.URLParams.Values) {
+			continue
+		}
+		params[key] = rctx.URLParams.Values[i]
+	}
+	return params
+}
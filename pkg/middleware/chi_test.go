@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestChiInterceptor_ResolvesSubrouterPattern(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager, config.ApiConfigStrategy{
+		Method:                http.MethodGet,
+		Url:                   "/api/orders/{id}",
+		IdentityFieldName:     stringPtr("id"),
+		IdentityFieldLocation: stringPtr("path_params"),
+	})
+
+	var handlerPattern string
+	r := chi.NewRouter()
+	r.Use(api.ChiInterceptor())
+	r.Route("/api", func(r chi.Router) {
+		r.Get("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+			handlerPattern = chi.RouteContext(r.Context()).RoutePattern()
+			w.WriteHeader(http.StatusAccepted)
+		})
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/orders/9", nil))
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "/api/orders/{id}", handlerPattern)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GET /api/orders/{id} 9", alloc.Alias)
+		assert.Equal(t, map[string]string{"id": "9"}, alloc.Metadata["pathParams"])
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusAccepted, use.Metadata["responseStatusCode"])
+	}
+}
+
+func TestChiInterceptor_InlineMiddleware(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	r := chi.NewRouter()
+	r.With(api.ChiInterceptor()).Post("/items/{sku}", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/items/abc", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "POST /items/{sku}", alloc.Alias)
+	}
+}
+
+func TestChiInterceptor_ResolvedPatternDrivesRouteMatching(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.forceMonitorAll = false
+	api.monitoringPathsMap = routesToMap([]config.Route{{Method: http.MethodGet, URL: "/reports/{id}"}})
+	api.Whitelist(config.Route{Method: "*", URL: "/health"})
+
+	r := chi.NewRouter()
+	r.Use(api.ChiInterceptor())
+	r.Get("/reports/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/other/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, path := range []string{"/health", "/other/1", "/reports/1"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if assert.Len(t, manager.sentMessages, 2, "only the monitored pattern is metered") {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GET /reports/{id}", alloc.Alias)
+	}
+}
+
+func TestChiInterceptor_UnmatchedRouteFallsBackToPath(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	r := chi.NewRouter()
+	r.Use(api.ChiInterceptor())
+	r.Get("/known", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GET /nope", alloc.Alias)
+	}
+}
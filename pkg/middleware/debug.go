@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/tracker"
+)
+
+// DebugState is a snapshot of the agent's live configuration and recent
+// decisions, for answering "why was (or wasn't) this request metered?".
+type DebugState struct {
+	Connected bool `json:"connected"`
+	// Slots is the state of each WebSocket pool slot; empty for transports
+	// without a pool.
+	Slots            []socket.SlotStatus                 `json:"slots"`
+	ApiConfig        []config.ApiConfigStrategy          `json:"apiConfig"`
+	FunctionPolicies map[string]config.ApiConfigStrategy `json:"functionPolicies"`
+	// MonitoringPaths and WhitelistEndpoints are the route maps requests are
+	// matched against, by method then URL. WhitelistEndpoints includes
+	// routes added with Whitelist, which are also listed in LocalWhitelist.
+	MonitoringPaths    map[string]map[string]bool `json:"monitoringPaths"`
+	WhitelistEndpoints map[string]map[string]bool `json:"whitelistEndpoints"`
+	LocalWhitelist     []config.Route             `json:"localWhitelist"`
+	// ScopedMonitoringPaths and ScopedWhitelist are the routes with a Host
+	// or Headers predicate, which are not in the maps above.
+	ScopedMonitoringPaths []config.Route `json:"scopedMonitoringPaths,omitempty"`
+	ScopedWhitelist       []config.Route `json:"scopedWhitelist,omitempty"`
+	// BlockedEndpoints lists blocked "METHOD url [identity]" keys.
+	BlockedEndpoints  []string `json:"blockedEndpoints"`
+	AccountReachLimit bool     `json:"accountReachLimit"`
+	ForceMonitorAll   bool     `json:"forceMonitorAll"`
+	DiscoveryEnabled  bool     `json:"discoveryEnabled"`
+	// LastRefresh is when each config section was last fetched
+	// successfully; RefreshErrors holds the error of sections whose latest
+	// fetch failed.
+	LastRefresh   map[string]time.Time `json:"lastRefresh"`
+	RefreshErrors map[string]string    `json:"refreshErrors,omitempty"`
+	// RecentDecisions are the latest requests seen, newest first.
+	RecentDecisions []Decision `json:"recentDecisions"`
+}
+
+// slotSource is implemented by transports with a connection pool, such as
+// socket.UsageFlowSocketManager.
+type slotSource interface {
+	Slots() []socket.SlotStatus
+}
+
+// DebugState returns a snapshot of the agent's live state.
+func (u *UsageFlowAPI) DebugState() DebugState {
+	state := DebugState{
+		Connected:        u.isConnected(),
+		DiscoveryEnabled: tracker.IsEnabled(),
+		RecentDecisions:  u.decisions.recent(),
+	}
+	if src, ok := u.transport.(slotSource); ok {
+		state.Slots = src.Slots()
+	}
+
+	u.mu.RLock()
+	state.ApiConfig = slices.Clone(u.ApiConfig)
+	state.FunctionPolicies = maps.Clone(u.functionPolicies)
+	state.MonitoringPaths = cloneRouteMap(u.monitoringPathsMap)
+	state.WhitelistEndpoints = cloneRouteMap(u.whitelistEndpointsMap)
+	state.LocalWhitelist = slices.Clone(u.localWhitelist)
+	state.ScopedMonitoringPaths = scopedRoutes(u.MonitoringPaths)
+	state.ScopedWhitelist = scopedRoutes(u.WhitelistEndpoints, u.localWhitelist)
+	state.BlockedEndpoints = slices.Sorted(maps.Keys(u.BlockedEndpoints))
+	state.AccountReachLimit = u.accountReachLimit
+	state.ForceMonitorAll = u.forceMonitorAll
+	u.mu.RUnlock()
+
+	u.metrics.mu.Lock()
+	state.LastRefresh = maps.Clone(u.metrics.lastRefresh)
+	state.RefreshErrors = maps.Clone(u.metrics.lastError)
+	u.metrics.mu.Unlock()
+	return state
+}
+
+// DebugHandler serves DebugState as JSON, for mounting at a path such as
+// /debug/usageflow. The state includes route configuration and request
+// paths, so mount it behind the same protection as other debug endpoints.
+func (u *UsageFlowAPI) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(u.DebugState())
+	})
+}
+
+func scopedRoutes(routeSets ...[]config.Route) []config.Route {
+	var out []config.Route
+	for _, routes := range routeSets {
+		for _, route := range routes {
+			if isScopedRoute(route) {
+				out = append(out, route)
+			}
+		}
+	}
+	return out
+}
+
+func cloneRouteMap(routes map[string]map[string]bool) map[string]map[string]bool {
+	out := make(map[string]map[string]bool, len(routes))
+	for method, urls := range routes {
+		out[method] = maps.Clone(urls)
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+)
+
+func TestDebugState_ExplainsDecisions(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodPost, Url: "/orders"})
+	api.forceMonitorAll = false
+	api.monitoringPathsMap = routesToMap([]config.Route{{Method: http.MethodPost, URL: "/orders"}})
+	api.Whitelist(config.Route{Method: "*", URL: "/health"})
+	api.BlockedEndpoints["DELETE /admin"] = true
+	api.metrics.configRefresh(sectionPolicies, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {})
+	handler := api.HTTPInterceptor()(mux)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/health", nil),
+		httptest.NewRequest(http.MethodGet, "/other", nil),
+		httptest.NewRequest(http.MethodPost, "/orders", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	state := api.DebugState()
+	assert.True(t, state.Connected)
+	assert.Equal(t, []string{"DELETE /admin"}, state.BlockedEndpoints)
+	assert.Equal(t, []config.Route{{Method: "*", URL: "/health"}}, state.LocalWhitelist)
+	assert.True(t, state.WhitelistEndpoints["*"]["/health"])
+	assert.True(t, state.MonitoringPaths[http.MethodPost]["/orders"])
+	assert.Contains(t, state.LastRefresh, sectionPolicies)
+
+	require.Len(t, state.RecentDecisions, 3)
+	assert.Equal(t, OutcomeSent, state.RecentDecisions[0].Outcome)
+	assert.Equal(t, "POST /orders", state.RecentDecisions[0].Alias)
+	assert.NotEmpty(t, state.RecentDecisions[0].AllocationID)
+	assert.Equal(t, OutcomeNotMonitored, state.RecentDecisions[1].Outcome)
+	assert.Equal(t, "/other", state.RecentDecisions[1].Path)
+	assert.Equal(t, "/", state.RecentDecisions[1].Route)
+	assert.Equal(t, OutcomeWhitelisted, state.RecentDecisions[2].Outcome)
+
+	assert.Equal(t, []AllocationCount{{Route: "POST /orders", Outcome: OutcomeSent, Count: 1}}, api.Metrics().Allocations,
+		"requests that are not metered stay out of allocation metrics")
+}
+
+func TestDebugHandler_ServesJSON(t *testing.T) {
+	api := newTestAPI(&fakeSocketManager{connected: true})
+	api.metrics.configRefresh(sectionBlockedEndpoints, assert.AnError)
+
+	w := httptest.NewRecorder()
+	api.DebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/usageflow", nil))
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, true, body["connected"])
+	assert.Equal(t, map[string]any{sectionBlockedEndpoints: assert.AnError.Error()}, body["refreshErrors"])
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+)
+
+// Outcomes of requests let through without metering. They appear in
+// decisions but not in allocation metrics.
+const (
+	// OutcomeWhitelisted means the route is whitelisted.
+	OutcomeWhitelisted = "whitelisted"
+	// OutcomePlanCap means the account reached its plan limit and metering
+	// is paused.
+	OutcomePlanCap = "plan_cap"
+	// OutcomeNotMonitored means the route is not in the monitored paths.
+	OutcomeNotMonitored = "not_monitored"
+)
+
+// recentDecisions is how many decisions DebugState keeps.
+const recentDecisions = 100
+
+// unmatchedRoute is the metrics route label of requests the router did not
+// match, so probes of arbitrary paths don't add a series each.
+const unmatchedRoute = "unmatched"
+
+// Decision records what the agent did with one request. Outcome is one of
+// OutcomeWhitelisted, OutcomePlanCap, OutcomeNotMonitored, OutcomeBlocked,
+// OutcomeDenied, OutcomeFailedOpen or OutcomeSent (metered).
+type Decision struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// Route is the route pattern the request matched.
+	Route string `json:"route"`
+	Path  string `json:"path"`
+	// Alias is the ledger alias, set once the request is metered.
+	Alias string `json:"alias,omitempty"`
+	// Policy is the API policy that matched the route, if any; Identity is
+	// the identity it resolved, as used in Alias.
+	Policy       *config.ApiConfigStrategy `json:"policy,omitempty"`
+	Identity     string                    `json:"identity,omitempty"`
+	Outcome      string                    `json:"outcome"`
+	AllocationID string                    `json:"allocationId,omitempty"`
+	Error        string                    `json:"error,omitempty"`
+}
+
+// decisionLog is a ring buffer of the latest decisions. The zero value is
+// ready to use.
+type decisionLog struct {
+	mu   sync.Mutex
+	buf  []Decision
+	next int
+}
+
+func (l *decisionLog) add(d Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) < recentDecisions {
+		l.buf = append(l.buf, d)
+		return
+	}
+	l.buf[l.next] = d
+	l.next = (l.next + 1) % recentDecisions
+}
+
+// recent returns the logged decisions, newest first.
+func (l *decisionLog) recent() []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]Decision, 0, len(l.buf))
+	for i := len(l.buf) - 1; i >= 0; i-- {
+		out = append(out, l.buf[(l.next+i)%len(l.buf)])
+	}
+	return out
+}
+
+// decide completes d (the alias, policy and identity matched so far) with
+// the outcome for rc and records it: in the recent decisions, the decision
+// hook and, for metered requests, the allocation metrics.
+func (u *UsageFlowAPI) decide(rc requestContext, d Decision, outcome string, err error) {
+	req := rc.Request()
+	d.Time = time.Now()
+	d.Method = req.Method
+	d.Route = rc.RoutePattern()
+	d.Path = req.URL.Path
+	d.Outcome = outcome
+	if d.Policy != nil {
+		policy := *d.Policy
+		d.Policy = &policy
+	}
+	if id, ok := rc.Get("eventId"); ok {
+		d.AllocationID, _ = id.(string)
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	u.decisions.add(d)
+	if u.decisionHook != nil {
+		u.callDecisionHook(d)
+	}
+
+	switch outcome {
+	case OutcomeWhitelisted, OutcomePlanCap, OutcomeNotMonitored:
+	default:
+		route := d.Method + " " + d.Route
+		if !rc.RouteMatched() {
+			route = unmatchedRoute
+		}
+		u.metrics.allocation(route, outcome)
+	}
+}
+
+// callDecisionHook runs the hook, keeping its panics from failing the
+// request.
+func (u *UsageFlowAPI) callDecisionHook(d Decision) {
+	defer u.recoverPanic("decision hook")
+	u.decisionHook(d)
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestWithDecisionHook_ReportsPolicyAndIdentity(t *testing.T) {
+	manager := &fakeSocketManager{
+		connected: true,
+		responses: []*socket.UsageFlowSocketResponse{
+			{Type: "error", Error: "quota exceeded"},
+		},
+	}
+	api := newTestAPI(manager, config.ApiConfigStrategy{
+		Method:                http.MethodGet,
+		Url:                   "/search",
+		HasRateLimit:          true,
+		IdentityFieldName:     stringPtr("x-customer"),
+		IdentityFieldLocation: stringPtr("headers"),
+	})
+	api.Whitelist(config.Route{Method: "*", URL: "/health"})
+	var decisions []Decision
+	api.decisionHook = func(d Decision) { decisions = append(decisions, d) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {})
+	handler := api.HTTPInterceptor()(mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	req := httptest.NewRequest(http.MethodGet, "/search?q=go", nil)
+	req.Header.Set("x-customer", "acme")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Len(t, decisions, 2)
+	assert.Equal(t, OutcomeWhitelisted, decisions[0].Outcome)
+	assert.Nil(t, decisions[0].Policy)
+
+	denied := decisions[1]
+	assert.Equal(t, OutcomeDenied, denied.Outcome)
+	assert.Equal(t, "/search", denied.Route)
+	assert.Equal(t, "acme", denied.Identity)
+	assert.Equal(t, "GET /search acme", denied.Alias)
+	assert.Contains(t, denied.Error, "quota exceeded")
+	if assert.NotNil(t, denied.Policy) {
+		assert.True(t, denied.Policy.HasRateLimit)
+		assert.Equal(t, "/search", denied.Policy.Url)
+	}
+}
+
+func TestWithDecisionHook_PanicDoesNotFailRequest(t *testing.T) {
+	api := newTestAPI(&fakeSocketManager{connected: true})
+	api.Whitelist(config.Route{Method: "*", URL: "/health"})
+	api.decisionHook = func(Decision) { panic("sink down") }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	w := httptest.NewRecorder()
+	api.HTTPInterceptor()(mux).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestDecisionLog_KeepsLatest(t *testing.T) {
+	var log decisionLog
+	for i := 0; i < recentDecisions+5; i++ {
+		log.add(Decision{Time: time.Unix(int64(i), 0)})
+	}
+	recent := log.recent()
+	require.Len(t, recent, recentDecisions)
+	assert.Equal(t, int64(recentDecisions+4), recent[0].Time.Unix())
+	assert.Equal(t, int64(5), recent[len(recent)-1].Time.Unix())
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EchoInterceptor creates an Echo middleware with the same metering behavior
+// as RequestInterceptor. Echo's route pattern (c.Path(), e.g. "/users/:id")
+// is used as the metered route.
+func (u *UsageFlowAPI) EchoInterceptor() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rc := &echoRequest{c: c, next: next}
+			u.interceptRequest(rc)
+			return rc.err
+		}
+	}
+}
+
+// echoRequest adapts echo.Context to requestContext.
+type echoRequest struct {
+	c    echo.Context
+	next echo.HandlerFunc
+	// err is the handler (or abort) error returned to Echo's error handler.
+	err error
+}
+
+func (e *echoRequest) Request() *http.Request {
+	return e.c.Request()
+}
+
+func (e *echoRequest) SetRequest(r *http.Request) {
+	e.c.SetRequest(r)
+}
+
+func (e *echoRequest) RoutePattern() string {
+	if path := e.c.Path(); path != "" {
+		return path
+	}
+	return e.c.Request().URL.Path
+}
+
+func (e *echoRequest) RouteMatched() bool {
+	return e.c.Path() != ""
+}
+
+func (e *echoRequest) Param(name string) string {
+	return e.c.Param(name)
+}
+
+func (e *echoRequest) Params() map[string]string {
+	names := e.c.ParamNames()
+	if len(names) == 0 {
+		return nil
+	}
+	values := e.c.ParamValues()
+	params := make(map[string]string, len(names))
+	for i, name := range names {
+		if i < len(values) {
+			params[name] = values[i]
+		}
+	}
+	return params
+}
+
+func (e *echoRequest) ClientIP() string {
+	return e.c.RealIP()
+}
+
+func (e *echoRequest) Set(key string, value interface{}) {
+	e.c.Set(key, value)
+}
+
+func (e *echoRequest) Get(key string) (interface{}, bool) {
+	v := e.c.Get(key)
+	return v, v != nil
+}
+
+func (e *echoRequest) Next() {
+	e.err = e.next(e.c)
+}
+
+func (e *echoRequest) AbortWithJSON(code int, body map[string]interface{}) {
+	e.err = e.c.JSON(code, body)
+}
+
+func (e *echoRequest) CaptureResponse() *responseCapture {
+	res := e.c.Response()
+	writer := &httpCaptureWriter{
+		ResponseWriter: res.Writer,
+		capture:        newResponseCapture(),
+	}
+	res.Writer = writer
+	return writer.capture
+}
+
+// Status returns the committed status, or the status Echo's error handler
+// will write when the handler returned an error without responding.
+func (e *echoRequest) Status() int {
+	res := e.c.Response()
+	if res.Committed || e.err == nil {
+		return res.Status
+	}
+	var httpErr *echo.HTTPError
+	if errors.As(e.err, &httpErr) {
+		return httpErr.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestEchoInterceptor_MetersRoutePattern(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager, config.ApiConfigStrategy{
+		Method:                http.MethodGet,
+		Url:                   "/users/:id",
+		IdentityFieldName:     stringPtr("id"),
+		IdentityFieldLocation: stringPtr("path_params"),
+	})
+
+	e := echo.New()
+	e.Use(api.EchoInterceptor())
+	e.GET("/users/:id", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{"id": c.Param("id")})
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/42", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GET /users/:id 42", alloc.Alias)
+		assert.Equal(t, map[string]string{"id": "42"}, alloc.Metadata["pathParams"])
+
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusOK, use.Metadata["responseStatusCode"])
+		assert.Equal(t, map[string]interface{}{"id": "42"}, use.Metadata["body"])
+	}
+}
+
+func TestEchoInterceptor_HandlerErrorStatus(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	e := echo.New()
+	e.Use(api.EchoInterceptor())
+	e.GET("/missing", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusNotFound, "not found")
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	if assert.Len(t, manager.sentMessages, 2) {
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusNotFound, use.Metadata["responseStatusCode"])
+	}
+}
+
+func TestEchoInterceptor_BlockedEndpointReturns403(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.BlockedEndpoints = map[string]bool{"GET /admin": true}
+
+	handlerCalled := false
+	e := echo.New()
+	e.Use(api.EchoInterceptor())
+	e.GET("/admin", func(c echo.Context) error {
+		handlerCalled = true
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin", nil))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, handlerCalled)
+	assert.Contains(t, w.Body.String(), "endpoint_blocked")
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -17,7 +18,7 @@ func (u *UsageFlowAPI) wireFunctionAllocationCallbacks() {
 }
 
 func (u *UsageFlowAPI) onDiscoveredFunctionStart(store *tracker.TrackingContext, funcName, filePath string) (string, error) {
-	defer func() { _ = recover() }()
+	defer u.recoverPanic("onDiscoveredFunctionStart")
 
 	u.mu.RLock()
 	reportAll := u.reportAllFunctionAllocations
@@ -59,7 +60,7 @@ func (u *UsageFlowAPI) onDiscoveredFunctionStart(store *tracker.TrackingContext,
 	}
 
 	if hasPolicy && policy.HasRateLimit {
-		response, err := u.socketManager.SendAsync(&socket.UsageFlowSocketMessage{
+		response, err := u.transport.SendAsyncContext(context.Background(), &socket.UsageFlowSocketMessage{
 			Type:    "request_for_allocation",
 			Payload: payload,
 		})
@@ -86,7 +87,7 @@ func (u *UsageFlowAPI) onDiscoveredFunctionStart(store *tracker.TrackingContext,
 
 	allocationID := uuid.New().String()
 	payload.AllocationID = &allocationID
-	_ = u.socketManager.Send(&socket.UsageFlowSocketMessage{
+	u.sendEvent(&socket.UsageFlowSocketMessage{
 		Type:    "request_for_allocation",
 		Payload: payload,
 	})
@@ -94,7 +95,7 @@ func (u *UsageFlowAPI) onDiscoveredFunctionStart(store *tracker.TrackingContext,
 }
 
 func (u *UsageFlowAPI) onDiscoveredFunctionEnd(store *tracker.TrackingContext, info tracker.FunctionEndInfo) {
-	defer func() { _ = recover() }()
+	defer u.recoverPanic("onDiscoveredFunctionEnd")
 	if info.AllocationID == "" || !u.isConnected() {
 		return
 	}
@@ -162,7 +163,7 @@ func (u *UsageFlowAPI) onDiscoveredFunctionEnd(store *tracker.TrackingContext, i
 		metadata["amount"] = amount
 	}
 
-	_ = u.socketManager.Send(&socket.UsageFlowSocketMessage{
+	u.sendEvent(&socket.UsageFlowSocketMessage{
 		Type: "use_allocation",
 		Payload: &socket.UseAllocationRequest{
 			Alias:        "",
@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcMethod is the route method for RPCs, so Console rules and ledger IDs
+// read "GRPC /package.Service/Method".
+const grpcMethod = "GRPC"
+
+// UnaryServerInterceptor meters unary RPCs with the same allocation, fulfill
+// and identity extraction flow as RequestInterceptor. The full method name
+// is the route; identity is read from incoming metadata ("headers"), JWT
+// claims in the authorization metadata ("bearer_token") or the request
+// message ("body"). Policy denials map to codes.ResourceExhausted and
+// blocked endpoints to codes.PermissionDenied.
+func (u *UsageFlowAPI) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		rc := newGRPCRequest(ctx, info.FullMethod, req)
+		rc.next = func(ctx context.Context) {
+			rc.resp, rc.err = handler(ctx, req)
+		}
+		u.interceptRequest(rc)
+		return rc.resp, rc.err
+	}
+}
+
+// StreamServerInterceptor meters streaming RPCs once per stream. Identity can
+// come from metadata or JWT claims; messages are not inspected.
+func (u *UsageFlowAPI) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		rc := newGRPCRequest(ss.Context(), info.FullMethod, nil)
+		rc.next = func(ctx context.Context) {
+			rc.err = handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+		}
+		u.interceptRequest(rc)
+		return rc.err
+	}
+}
+
+// contextServerStream overrides the stream context so handlers see the
+// request-scoped tracking context.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcRequest adapts an RPC to requestContext. It synthesizes an
+// *http.Request carrying the incoming metadata as headers and the request
+// message as a JSON body, so identity extraction is shared with HTTP.
+type grpcRequest struct {
+	r       *http.Request
+	next    func(ctx context.Context)
+	values  map[string]interface{}
+	capture *responseCapture
+	resp    interface{}
+	err     error
+}
+
+func newGRPCRequest(ctx context.Context, fullMethod string, req interface{}) *grpcRequest {
+	header := make(http.Header)
+	var host string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if authority := md.Get(":authority"); len(authority) > 0 {
+			host = authority[0]
+		}
+		for key, values := range md {
+			if strings.HasPrefix(key, ":") {
+				continue
+			}
+			for _, value := range values {
+				header.Add(key, value)
+			}
+		}
+	}
+
+	r := (&http.Request{
+		Method:     grpcMethod,
+		URL:        &url.URL{Path: fullMethod},
+		RequestURI: fullMethod,
+		Host:       host,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     header,
+		Body:       http.NoBody,
+	}).WithContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if body := marshalGRPCMessage(req); body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+
+	return &grpcRequest{
+		r:      r,
+		values: make(map[string]interface{}),
+	}
+}
+
+// marshalGRPCMessage encodes a request/response message as JSON, using the
+// protobuf JSON mapping for proto messages.
+func marshalGRPCMessage(msg interface{}) []byte {
+	if msg == nil {
+		return nil
+	}
+	var (
+		body []byte
+		err  error
+	)
+	if pm, ok := msg.(proto.Message); ok {
+		body, err = protojson.Marshal(pm)
+	} else {
+		body, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+func (g *grpcRequest) Request() *http.Request {
+	return g.r
+}
+
+func (g *grpcRequest) SetRequest(r *http.Request) {
+	g.r = r
+}
+
+func (g *grpcRequest) RoutePattern() string {
+	return g.r.URL.Path
+}
+
+// RouteMatched is always true: the route is the full method name, and gRPC
+// rejects unknown methods before interceptors run unless the server sets an
+// UnknownServiceHandler.
+func (g *grpcRequest) RouteMatched() bool {
+	return true
+}
+
+func (g *grpcRequest) Param(name string) string {
+	return ""
+}
+
+func (g *grpcRequest) Params() map[string]string {
+	return nil
+}
+
+func (g *grpcRequest) ClientIP() string {
+	host, _, err := net.SplitHostPort(g.r.RemoteAddr)
+	if err != nil {
+		return g.r.RemoteAddr
+	}
+	return host
+}
+
+func (g *grpcRequest) Set(key string, value interface{}) {
+	g.values[key] = value
+}
+
+func (g *grpcRequest) Get(key string) (interface{}, bool) {
+	v, ok := g.values[key]
+	return v, ok
+}
+
+func (g *grpcRequest) Next() {
+	g.next(g.r.Context())
+	if g.capture != nil && g.err == nil {
+		if body := marshalGRPCMessage(g.resp); body != nil {
+			g.capture.write(body)
+		}
+	}
+}
+
+// AbortWithJSON maps the interceptor's HTTP denial to a gRPC status.
+func (g *grpcRequest) AbortWithJSON(code int, body map[string]interface{}) {
+	message := fmt.Sprint(body["error"])
+	if detail, ok := body["message"].(string); ok && detail != "" {
+		message = fmt.Sprintf("%s: %s", message, detail)
+	}
+	g.err = status.Error(httpStatusToGRPCCode(code), message)
+}
+
+func (g *grpcRequest) CaptureResponse() *responseCapture {
+	g.capture = newResponseCapture()
+	return g.capture
+}
+
+// Status reports the RPC outcome as the equivalent HTTP status so metering
+// metadata stays comparable with HTTP routes.
+func (g *grpcRequest) Status() int {
+	return grpcCodeToHTTPStatus(status.Code(g.err))
+}
+
+func httpStatusToGRPCCode(code int) codes.Code {
+	switch code {
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	default:
+		return codes.Unavailable
+	}
+}
+
+// grpcCodeToHTTPStatus follows the grpc-gateway mapping.
+func grpcCodeToHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestUnaryServerInterceptor_MetersWithMetadataIdentity(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager, config.ApiConfigStrategy{
+		Method:                grpcMethod,
+		Url:                   "/orders.Orders/Get",
+		IdentityFieldName:     stringPtr("x-customer-id"),
+		IdentityFieldLocation: stringPtr("headers"),
+	})
+
+	req, err := structpb.NewStruct(map[string]interface{}{"orderId": "o-1"})
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-customer-id", "cust-7"))
+
+	resp, err := api.UnaryServerInterceptor()(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/orders.Orders/Get"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return structpb.NewStruct(map[string]interface{}{"status": "shipped"})
+		})
+
+	require.NoError(t, err)
+	assert.NotNil(t, resp)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GRPC /orders.Orders/Get cust-7", alloc.Alias)
+		assert.Equal(t, map[string]interface{}{"orderId": "o-1"}, alloc.Metadata["requestBody"])
+
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusOK, use.Metadata["responseStatusCode"])
+		assert.Equal(t, map[string]interface{}{"status": "shipped"}, use.Metadata["body"])
+	}
+}
+
+func TestUnaryServerInterceptor_JWTIdentityAndQuotaDenial(t *testing.T) {
+	manager := &fakeSocketManager{
+		connected: true,
+		responses: []*socket.UsageFlowSocketResponse{
+			{Type: "error", Error: "quota exceeded"},
+		},
+	}
+	api := newTestAPI(manager, config.ApiConfigStrategy{
+		Method:                grpcMethod,
+		Url:                   "/search.Search/Query",
+		IdentityFieldName:     stringPtr("sub"),
+		IdentityFieldLocation: stringPtr("bearer_token"),
+		HasRateLimit:          true,
+	})
+
+	token := createTestJWT(`{"sub":"user-1"}`)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+
+	handlerCalled := false
+	_, err := api.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/search.Search/Query"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			handlerCalled = true
+			return nil, nil
+		})
+
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.False(t, handlerCalled)
+	if assert.Len(t, manager.asyncMessages, 1) {
+		alloc := manager.asyncMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GRPC /search.Search/Query user-1", alloc.Alias)
+	}
+}
+
+func TestUnaryServerInterceptor_BlockedEndpoint(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.BlockedEndpoints = map[string]bool{"GRPC /admin.Admin/Wipe": true}
+
+	_, err := api.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/admin.Admin/Wipe"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatal("handler must not run for a blocked endpoint")
+			return nil, nil
+		})
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestUnaryServerInterceptor_HandlerErrorStatus(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	_, err := api.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/orders.Orders/Get"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.NotFound, "missing")
+		})
+
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	if assert.Len(t, manager.sentMessages, 2) {
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusNotFound, use.Metadata["responseStatusCode"])
+	}
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor_MetersStream(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "t-1"))
+	handlerCalled := false
+	err := api.StreamServerInterceptor()(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/feed.Feed/Watch"},
+		func(srv interface{}, stream grpc.ServerStream) error {
+			handlerCalled = true
+			md, ok := metadata.FromIncomingContext(stream.Context())
+			assert.True(t, ok)
+			assert.Equal(t, []string{"t-1"}, md.Get("x-tenant"))
+			return nil
+		})
+
+	require.NoError(t, err)
+	assert.True(t, handlerCalled)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GRPC /feed.Feed/Watch", alloc.Alias)
+	}
+}
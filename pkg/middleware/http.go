@@ -0,0 +1,257 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HTTPInterceptor creates a net/http middleware with the same metering
+// behavior as RequestInterceptor. The Go 1.22+ ServeMux pattern (e.g.
+// "/users/{id}") is used as the metered route; wrap either the mux itself or
+// individual handlers registered on it.
+func (u *UsageFlowAPI) HTTPInterceptor() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u.interceptRequest(newHTTPRequest(w, r, next, serveMuxRoute(next)))
+		})
+	}
+}
+
+// routeResolver returns the route pattern and path parameters for a request,
+// or an empty pattern when the router has no route for it. Resolution is
+// deferred until the interceptor first needs the route, so routers that only
+// know the final pattern after matching can resolve it on demand.
+type routeResolver func(r *http.Request) (pattern string, params map[string]string)
+
+// muxPatternResolver is implemented by *http.ServeMux.
+type muxPatternResolver interface {
+	Handler(r *http.Request) (http.Handler, string)
+}
+
+// serveMuxRoute resolves Go 1.22+ ServeMux patterns, whether the middleware
+// wraps a handler registered on the mux or the mux itself.
+func serveMuxRoute(next http.Handler) routeResolver {
+	return func(r *http.Request) (string, map[string]string) {
+		pattern := r.Pattern
+		if pattern == "" {
+			// The middleware wraps the mux, so routing has not happened yet.
+			if mux, ok := next.(muxPatternResolver); ok {
+				_, pattern = mux.Handler(r)
+			}
+		}
+		if pattern == "" {
+			return "", nil
+		}
+		pattern = muxPatternPath(pattern)
+		return pattern, muxPathValues(pattern, r.URL.Path)
+	}
+}
+
+// httpRequest adapts a net/http request to requestContext.
+type httpRequest struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	next     http.Handler
+	resolve  routeResolver
+	resolved bool
+	pattern  string
+	params   map[string]string
+	values   map[string]interface{}
+	capture  *httpCaptureWriter
+	aborted  bool
+}
+
+func newHTTPRequest(w http.ResponseWriter, r *http.Request, next http.Handler, resolve routeResolver) *httpRequest {
+	return &httpRequest{
+		w:       w,
+		r:       r,
+		next:    next,
+		resolve: resolve,
+		values:  make(map[string]interface{}),
+	}
+}
+
+func (h *httpRequest) resolveRoute() {
+	if h.resolved {
+		return
+	}
+	h.resolved = true
+	if h.resolve != nil {
+		h.pattern, h.params = h.resolve(h.r)
+	}
+}
+
+func (h *httpRequest) Request() *http.Request {
+	return h.r
+}
+
+func (h *httpRequest) SetRequest(r *http.Request) {
+	h.r = r
+}
+
+func (h *httpRequest) RoutePattern() string {
+	h.resolveRoute()
+	if h.pattern == "" {
+		return h.r.URL.Path
+	}
+	return h.pattern
+}
+
+func (h *httpRequest) RouteMatched() bool {
+	h.resolveRoute()
+	return h.pattern != ""
+}
+
+func (h *httpRequest) Param(name string) string {
+	if v := h.r.PathValue(name); v != "" {
+		return v
+	}
+	h.resolveRoute()
+	return h.params[name]
+}
+
+func (h *httpRequest) Params() map[string]string {
+	h.resolveRoute()
+	return h.params
+}
+
+func (h *httpRequest) ClientIP() string {
+	return remoteClientIP(h.r)
+}
+
+func (h *httpRequest) Set(key string, value interface{}) {
+	h.values[key] = value
+}
+
+func (h *httpRequest) Get(key string) (interface{}, bool) {
+	v, ok := h.values[key]
+	return v, ok
+}
+
+func (h *httpRequest) Next() {
+	if h.aborted {
+		return
+	}
+	var w http.ResponseWriter = h.w
+	if h.capture != nil {
+		w = h.capture
+	}
+	h.next.ServeHTTP(w, h.r)
+}
+
+func (h *httpRequest) AbortWithJSON(code int, body map[string]interface{}) {
+	h.aborted = true
+	h.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	h.w.WriteHeader(code)
+	_ = json.NewEncoder(h.w).Encode(body)
+}
+
+func (h *httpRequest) CaptureResponse() *responseCapture {
+	h.capture = &httpCaptureWriter{
+		ResponseWriter: h.w,
+		capture:        newResponseCapture(),
+	}
+	return h.capture.capture
+}
+
+func (h *httpRequest) Status() int {
+	if h.capture == nil {
+		return http.StatusOK
+	}
+	return h.capture.capture.statusCode
+}
+
+// httpCaptureWriter tees a net/http response body into a responseCapture.
+type httpCaptureWriter struct {
+	http.ResponseWriter
+	capture     *responseCapture
+	wroteHeader bool
+}
+
+func (w *httpCaptureWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.capture.statusCode = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *httpCaptureWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.capture.write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *httpCaptureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *httpCaptureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// muxPatternPath strips the optional method and host from a ServeMux pattern
+// ("GET api.example.com/users/{id}" -> "/users/{id}").
+func muxPatternPath(pattern string) string {
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = strings.TrimSpace(pattern[i+1:])
+	}
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		pattern = pattern[i:]
+	}
+	if trimmed := strings.TrimSuffix(pattern, "{$}"); trimmed != "" {
+		pattern = trimmed
+	}
+	return pattern
+}
+
+// muxPathValues matches a ServeMux path pattern against a request path and
+// returns the wildcard values. Needed when the middleware wraps the mux,
+// because PathValue is only populated once the mux dispatches.
+func muxPathValues(pattern, path string) map[string]string {
+	patternSegs := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegs := strings.Split(strings.Trim(path, "/"), "/")
+	var params map[string]string
+	for i, seg := range patternSegs {
+		if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") || seg == "{$}" {
+			continue
+		}
+		name := seg[1 : len(seg)-1]
+		if i >= len(pathSegs) {
+			break
+		}
+		value := pathSegs[i]
+		if strings.HasSuffix(name, "...") {
+			name = strings.TrimSuffix(name, "...")
+			value = strings.Join(pathSegs[i:], "/")
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// remoteClientIP mirrors Gin's default ClientIP lookup: X-Forwarded-For,
+// then X-Real-Ip, then the connection's remote address.
+func remoteClientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		if ip := strings.TrimSpace(strings.Split(forwarded, ",")[0]); ip != "" {
+			return ip
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func newTestAPI(manager *fakeSocketManager, policies ...config.ApiConfigStrategy) *UsageFlowAPI {
+	return &UsageFlowAPI{
+		ApiConfig:        policies,
+		BlockedEndpoints: map[string]bool{},
+		policyMap:        make(PolicyMap),
+		transport:        manager,
+		connected:        manager.connected,
+		forceMonitorAll:  true,
+		functionPolicies: make(map[string]config.ApiConfigStrategy),
+	}
+}
+
+func TestHTTPInterceptor_WrapsServeMux(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager, config.ApiConfigStrategy{
+		Method:                http.MethodGet,
+		Url:                   "/users/{id}",
+		IdentityFieldName:     stringPtr("id"),
+		IdentityFieldLocation: stringPtr("path_params"),
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"` + r.PathValue("id") + `"}`))
+	})
+
+	w := httptest.NewRecorder()
+	api.HTTPInterceptor()(mux).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/42", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"42"}`, w.Body.String())
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "GET /users/{id} 42", alloc.Alias)
+		assert.Equal(t, "/users/{id}", alloc.Metadata["url"])
+		assert.Equal(t, map[string]string{"id": "42"}, alloc.Metadata["pathParams"])
+
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusOK, use.Metadata["responseStatusCode"])
+		assert.Equal(t, map[string]interface{}{"id": "42"}, use.Metadata["body"])
+	}
+}
+
+func TestHTTPInterceptor_WrapsRegisteredHandler(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /orders/{id}", api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/7", strings.NewReader(`{"sku":"a"}`)))
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	if assert.Len(t, manager.sentMessages, 2) {
+		alloc := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+		assert.Equal(t, "POST /orders/{id}", alloc.Alias)
+		assert.Equal(t, map[string]interface{}{"sku": "a"}, alloc.Metadata["requestBody"])
+		use := manager.sentMessages[1].Payload.(*socket.UseAllocationRequest)
+		assert.Equal(t, http.StatusCreated, use.Metadata["responseStatusCode"])
+	}
+}
+
+func TestHTTPInterceptor_DeniedRateLimitReturns429(t *testing.T) {
+	manager := &fakeSocketManager{
+		connected: true,
+		responses: []*socket.UsageFlowSocketResponse{
+			{Type: "error", Error: "quota exceeded"},
+		},
+	}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodGet, Url: "/search", HasRateLimit: true})
+
+	handlerCalled := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		handlerCalled = true
+	})
+
+	w := httptest.NewRecorder()
+	api.HTTPInterceptor()(mux).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/search", nil))
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.False(t, handlerCalled)
+	assert.Contains(t, w.Body.String(), "rate_limit_exceeded")
+}
+
+func TestHTTPInterceptor_WhitelistedRouteSkipsMetering(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.Whitelist(config.Route{Method: "*", URL: "/health"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	api.HTTPInterceptor()(mux).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, manager.sentMessages)
+}
+
+func TestMuxPatternPath(t *testing.T) {
+	assert.Equal(t, "/users/{id}", muxPatternPath("GET /users/{id}"))
+	assert.Equal(t, "/users/{id}", muxPatternPath("GET api.example.com/users/{id}"))
+	assert.Equal(t, "/static/", muxPatternPath("/static/"))
+	assert.Equal(t, "/", muxPatternPath("GET /{$}"))
+	assert.Equal(t, "/a/", muxPatternPath("/a/{$}"))
+}
+
+func TestMuxPathValues(t *testing.T) {
+	assert.Equal(t, map[string]string{"id": "42"}, muxPathValues("/users/{id}", "/users/42"))
+	assert.Equal(t, map[string]string{"org": "acme", "path": "a/b/c"}, muxPathValues("/{org}/files/{path...}", "/acme/files/a/b/c"))
+	assert.Nil(t, muxPathValues("/health", "/health"))
+}
+
+func TestRemoteClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", remoteClientIP(r))
+
+	r.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+	assert.Equal(t, "203.0.113.5", remoteClientIP(r))
+}
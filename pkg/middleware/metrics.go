@@ -0,0 +1,331 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+// Allocation outcomes reported in Metrics.
+const (
+	// OutcomeSent means the allocation reached UsageFlow (or the spool) and
+	// the request was metered.
+	OutcomeSent = "sent"
+	// OutcomeDenied means UsageFlow denied a rate-limited request (429).
+	OutcomeDenied = "denied"
+	// OutcomeBlocked means the endpoint is blocked by policy (403).
+	OutcomeBlocked = "blocked"
+	// OutcomeFailedOpen means UsageFlow was unreachable or too slow and the
+	// request was served without metering.
+	OutcomeFailedOpen = "failed_open"
+)
+
+// Config sections reported in Metrics.
+const (
+	sectionPolicies          = "policies"
+	sectionApplicationConfig = "application_config"
+	sectionBlockedEndpoints  = "blocked_endpoints"
+)
+
+// allocationLatencyBuckets are the upper bounds, in seconds, of the
+// rate-limited allocation latency histogram.
+var allocationLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Metrics is a point-in-time snapshot of agent internals.
+type Metrics struct {
+	// Allocations counts metered requests by route and outcome.
+	Allocations []AllocationCount
+	// AllocationLatency is the round-trip time of rate-limited allocations.
+	AllocationLatency Histogram
+	// Reconnects counts pool connections re-established after a drop.
+	Reconnects uint64
+	// ConnectionsUp is the number of pool connections currently up.
+	ConnectionsUp int
+	// Queue reports the outbound queue (see WithOutboundQueue).
+	Queue socket.QueueStats
+	// DroppedEvents counts metering events the transport rejected.
+	DroppedEvents int64
+	// ConfigRefreshes counts config fetches by section and result.
+	ConfigRefreshes []ConfigRefreshCount
+	// ConfigAge is the time since each section was last fetched
+	// successfully. Sections never fetched are absent.
+	ConfigAge map[string]time.Duration
+	// CallChainReports counts report_call_chain messages sent.
+	CallChainReports uint64
+}
+
+// AllocationCount is one route/outcome counter. Route is "METHOD pattern",
+// or "unmatched" for requests the router had no pattern for.
+type AllocationCount struct {
+	Route   string
+	Outcome string
+	Count   uint64
+}
+
+// ConfigRefreshCount is one section/result counter; Result is "success" or
+// "failure".
+type ConfigRefreshCount struct {
+	Section string
+	Result  string
+	Count   uint64
+}
+
+// Histogram holds cumulative bucket counts for the upper bounds in Buckets.
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+type allocationKey struct{ route, outcome string }
+type refreshKey struct{ section, result string }
+
+// agentMetrics collects the counters behind Metrics. The zero value is
+// ready to use.
+type agentMetrics struct {
+	mu          sync.Mutex
+	allocations map[allocationKey]uint64
+	latency     Histogram
+	reconnects  uint64
+	// connectedSlots holds the pool slots that have connected before, so
+	// only their later connects count as reconnects.
+	connectedSlots map[int]bool
+	refreshes      map[refreshKey]uint64
+	lastRefresh    map[string]time.Time
+	lastError      map[string]string
+	callChains     uint64
+}
+
+func (m *agentMetrics) allocation(route, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.allocations == nil {
+		m.allocations = make(map[allocationKey]uint64)
+	}
+	m.allocations[allocationKey{route, outcome}]++
+}
+
+func (m *agentMetrics) allocationLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency.Counts == nil {
+		m.latency.Buckets = allocationLatencyBuckets
+		m.latency.Counts = make([]uint64, len(allocationLatencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range m.latency.Buckets {
+		if seconds <= bound {
+			m.latency.Counts[i]++
+		}
+	}
+	m.latency.Sum += seconds
+	m.latency.Count++
+}
+
+func (m *agentMetrics) configRefresh(section string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refreshes == nil {
+		m.refreshes = make(map[refreshKey]uint64)
+		m.lastRefresh = make(map[string]time.Time)
+		m.lastError = make(map[string]string)
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+		m.lastError[section] = err.Error()
+	} else {
+		m.lastRefresh[section] = time.Now()
+		delete(m.lastError, section)
+	}
+	m.refreshes[refreshKey{section, result}]++
+}
+
+func (m *agentMetrics) reconnect() {
+	m.mu.Lock()
+	m.reconnects++
+	m.mu.Unlock()
+}
+
+// slotConnected records that the pool slot index connected and, unless
+// seeding from the initial dial, counts a reconnect if it had connected
+// before.
+func (m *agentMetrics) slotConnected(index int, seed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connectedSlots[index] {
+		if !seed {
+			m.reconnects++
+		}
+		return
+	}
+	if m.connectedSlots == nil {
+		m.connectedSlots = make(map[int]bool)
+	}
+	m.connectedSlots[index] = true
+}
+
+func (m *agentMetrics) callChain() {
+	m.mu.Lock()
+	m.callChains++
+	m.mu.Unlock()
+}
+
+// stateSource is implemented by transports that report connection events,
+// such as socket.UsageFlowSocketManager.
+type stateSource interface {
+	OnStateChange(fn func(socket.ConnectionEvent)) func()
+	HealthyConnections() int
+}
+
+// subscribeMetrics counts reconnects. It subscribes after the initial dial,
+// so slots that are already up are recorded as connected before; a slot's
+// first connect after a failed initial dial is not a reconnect.
+func (u *UsageFlowAPI) subscribeMetrics() {
+	src, ok := u.transport.(stateSource)
+	if !ok {
+		return
+	}
+	src.OnStateChange(func(e socket.ConnectionEvent) {
+		if e.New == socket.StateConnected {
+			u.metrics.slotConnected(e.Index, false)
+		}
+	})
+	if slots, ok := u.transport.(slotSource); ok {
+		for _, slot := range slots.Slots() {
+			if slot.State == socket.StateConnected {
+				u.metrics.slotConnected(slot.Index, true)
+			}
+		}
+	}
+}
+
+// Metrics returns a snapshot of agent counters: allocations by route and
+// outcome, rate-limited allocation latency, reconnects, pool connections
+// up, queue depth, config refreshes and age, and call-chain reports.
+func (u *UsageFlowAPI) Metrics() Metrics {
+	m := &u.metrics
+	m.mu.Lock()
+	snapshot := Metrics{
+		Reconnects:       m.reconnects,
+		CallChainReports: m.callChains,
+		ConfigAge:        make(map[string]time.Duration, len(m.lastRefresh)),
+		AllocationLatency: Histogram{
+			Buckets: allocationLatencyBuckets,
+			Counts:  make([]uint64, len(allocationLatencyBuckets)),
+			Sum:     m.latency.Sum,
+			Count:   m.latency.Count,
+		},
+	}
+	copy(snapshot.AllocationLatency.Counts, m.latency.Counts)
+	for key, n := range m.allocations {
+		snapshot.Allocations = append(snapshot.Allocations, AllocationCount{Route: key.route, Outcome: key.outcome, Count: n})
+	}
+	for key, n := range m.refreshes {
+		snapshot.ConfigRefreshes = append(snapshot.ConfigRefreshes, ConfigRefreshCount{Section: key.section, Result: key.result, Count: n})
+	}
+	now := time.Now()
+	for section, at := range m.lastRefresh {
+		snapshot.ConfigAge[section] = now.Sub(at)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(snapshot.Allocations, func(i, j int) bool {
+		a, b := snapshot.Allocations[i], snapshot.Allocations[j]
+		return a.Route < b.Route || (a.Route == b.Route && a.Outcome < b.Outcome)
+	})
+	sort.Slice(snapshot.ConfigRefreshes, func(i, j int) bool {
+		a, b := snapshot.ConfigRefreshes[i], snapshot.ConfigRefreshes[j]
+		return a.Section < b.Section || (a.Section == b.Section && a.Result < b.Result)
+	})
+
+	if src, ok := u.transport.(stateSource); ok {
+		snapshot.ConnectionsUp = src.HealthyConnections()
+	} else if u.transport != nil && u.transport.IsConnected() {
+		snapshot.ConnectionsUp = 1
+	}
+	snapshot.Queue = u.QueueStats()
+	snapshot.DroppedEvents = u.droppedEvents.Load()
+	return snapshot
+}
+
+// MetricsHandler serves Metrics in the Prometheus text exposition format,
+// for mounting at /metrics or alongside an existing Prometheus handler.
+func (u *UsageFlowAPI) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, u.Metrics())
+	})
+}
+
+func writeMetrics(w io.Writer, m Metrics) {
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("usageflow_allocations_total", "counter", "Metered requests by route and outcome (sent, denied, blocked, failed_open).")
+	for _, a := range m.Allocations {
+		fmt.Fprintf(w, "usageflow_allocations_total{route=%s,outcome=%s} %d\n", quoteLabel(a.Route), quoteLabel(a.Outcome), a.Count)
+	}
+
+	header("usageflow_allocation_duration_seconds", "histogram", "Round-trip time of rate-limited allocations.")
+	for i, bound := range m.AllocationLatency.Buckets {
+		fmt.Fprintf(w, "usageflow_allocation_duration_seconds_bucket{le=%q} %d\n", formatFloat(bound), m.AllocationLatency.Counts[i])
+	}
+	fmt.Fprintf(w, "usageflow_allocation_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.AllocationLatency.Count)
+	fmt.Fprintf(w, "usageflow_allocation_duration_seconds_sum %s\n", formatFloat(m.AllocationLatency.Sum))
+	fmt.Fprintf(w, "usageflow_allocation_duration_seconds_count %d\n", m.AllocationLatency.Count)
+
+	header("usageflow_reconnects_total", "counter", "Pool connections re-established after a drop.")
+	fmt.Fprintf(w, "usageflow_reconnects_total %d\n", m.Reconnects)
+
+	header("usageflow_connections_up", "gauge", "Pool connections currently up.")
+	fmt.Fprintf(w, "usageflow_connections_up %d\n", m.ConnectionsUp)
+
+	header("usageflow_queue_depth", "gauge", "Frames waiting in outbound queues.")
+	fmt.Fprintf(w, "usageflow_queue_depth %d\n", m.Queue.Depth)
+
+	header("usageflow_queue_dropped_total", "counter", "Messages lost to outbound queues by reason.")
+	fmt.Fprintf(w, "usageflow_queue_dropped_total{reason=\"rejected\"} %d\n", m.Queue.Rejected)
+	fmt.Fprintf(w, "usageflow_queue_dropped_total{reason=\"evicted\"} %d\n", m.Queue.Evicted)
+	fmt.Fprintf(w, "usageflow_queue_dropped_total{reason=\"undelivered\"} %d\n", m.Queue.Undelivered)
+
+	header("usageflow_events_dropped_total", "counter", "Metering events the transport rejected.")
+	fmt.Fprintf(w, "usageflow_events_dropped_total %d\n", m.DroppedEvents)
+
+	header("usageflow_config_refreshes_total", "counter", "Config fetches by section and result.")
+	for _, r := range m.ConfigRefreshes {
+		fmt.Fprintf(w, "usageflow_config_refreshes_total{section=%s,result=%s} %d\n", quoteLabel(r.Section), quoteLabel(r.Result), r.Count)
+	}
+
+	header("usageflow_config_age_seconds", "gauge", "Seconds since each config section was last fetched successfully.")
+	sections := make([]string, 0, len(m.ConfigAge))
+	for section := range m.ConfigAge {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		fmt.Fprintf(w, "usageflow_config_age_seconds{section=%s} %s\n", quoteLabel(section), formatFloat(m.ConfigAge[section].Seconds()))
+	}
+
+	header("usageflow_call_chain_reports_total", "counter", "report_call_chain messages sent.")
+	fmt.Fprintf(w, "usageflow_call_chain_reports_total %d\n", m.CallChainReports)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestMetrics_RecordsAllocationOutcomes(t *testing.T) {
+	manager := &fakeSocketManager{
+		connected: true,
+		responses: []*socket.UsageFlowSocketResponse{
+			{Type: "error", Error: "quota exceeded"},
+		},
+	}
+	api := newTestAPI(manager,
+		config.ApiConfigStrategy{Method: http.MethodPost, Url: "/orders"},
+		config.ApiConfigStrategy{Method: http.MethodGet, Url: "/search", HasRateLimit: true},
+	)
+	api.BlockedEndpoints["DELETE /admin"] = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("DELETE /admin", func(w http.ResponseWriter, r *http.Request) {})
+	handler := api.HTTPInterceptor()(mux)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/orders", nil),
+		httptest.NewRequest(http.MethodGet, "/search", nil),
+		httptest.NewRequest(http.MethodDelete, "/admin", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	metrics := api.Metrics()
+	assert.Equal(t, []AllocationCount{
+		{Route: "DELETE /admin", Outcome: OutcomeBlocked, Count: 1},
+		{Route: "GET /search", Outcome: OutcomeDenied, Count: 1},
+		{Route: "POST /orders", Outcome: OutcomeSent, Count: 1},
+	}, metrics.Allocations)
+	assert.Equal(t, uint64(1), metrics.AllocationLatency.Count)
+	assert.Equal(t, 1, metrics.ConnectionsUp)
+}
+
+func TestMetrics_UnmatchedRoutesShareOneLabel(t *testing.T) {
+	api := newTestAPI(&fakeSocketManager{connected: true})
+	handler := api.HTTPInterceptor()(http.NewServeMux())
+	for _, path := range []string{"/wp-login.php", "/.env", "/admin/config.php"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, []AllocationCount{{Route: unmatchedRoute, Outcome: OutcomeSent, Count: 3}}, api.Metrics().Allocations)
+}
+
+func TestMetrics_FailedOpenWhenDisconnected(t *testing.T) {
+	manager := &fakeSocketManager{connected: false}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodGet, Url: "/search", HasRateLimit: true})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	api.HTTPInterceptor()(mux).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/search", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []AllocationCount{{Route: "GET /search", Outcome: OutcomeFailedOpen, Count: 1}}, api.Metrics().Allocations)
+	assert.Equal(t, 0, api.Metrics().ConnectionsUp)
+}
+
+func TestMetrics_ConfigRefreshes(t *testing.T) {
+	api := newTestAPI(&fakeSocketManager{connected: true})
+	api.metrics.configRefresh(sectionPolicies, nil)
+	api.metrics.configRefresh(sectionPolicies, errors.New("timeout"))
+	api.metrics.configRefresh(sectionBlockedEndpoints, errors.New("timeout"))
+
+	metrics := api.Metrics()
+	assert.Equal(t, []ConfigRefreshCount{
+		{Section: sectionBlockedEndpoints, Result: "failure", Count: 1},
+		{Section: sectionPolicies, Result: "failure", Count: 1},
+		{Section: sectionPolicies, Result: "success", Count: 1},
+	}, metrics.ConfigRefreshes)
+	require.Contains(t, metrics.ConfigAge, sectionPolicies)
+	assert.NotContains(t, metrics.ConfigAge, sectionBlockedEndpoints)
+}
+
+// poolTransport reports pool slots and lets the test drive state changes.
+type poolTransport struct {
+	*fakeSocketManager
+	slots    []socket.SlotStatus
+	listener func(socket.ConnectionEvent)
+}
+
+func (p *poolTransport) Slots() []socket.SlotStatus { return p.slots }
+func (p *poolTransport) HealthyConnections() int    { return 1 }
+
+func (p *poolTransport) OnStateChange(fn func(socket.ConnectionEvent)) func() {
+	p.listener = fn
+	return func() {}
+}
+
+func TestMetrics_CountsOnlyReconnects(t *testing.T) {
+	transport := &poolTransport{
+		fakeSocketManager: &fakeSocketManager{connected: true},
+		slots: []socket.SlotStatus{
+			{Index: 0, State: socket.StateConnected},
+			{Index: 1, State: socket.StateDisconnected},
+		},
+	}
+	api := newTestAPI(transport.fakeSocketManager)
+	api.transport = transport
+	api.subscribeMetrics()
+
+	transport.listener(socket.ConnectionEvent{Index: 1, Old: socket.StateConnecting, New: socket.StateConnected})
+	assert.Zero(t, api.Metrics().Reconnects, "a slot's first connect after a failed initial dial is not a reconnect")
+
+	transport.listener(socket.ConnectionEvent{Index: 0, Old: socket.StateConnected, New: socket.StateDisconnected})
+	transport.listener(socket.ConnectionEvent{Index: 0, Old: socket.StateConnecting, New: socket.StateConnected})
+	transport.listener(socket.ConnectionEvent{Index: 1, Old: socket.StateConnecting, New: socket.StateConnected})
+	assert.Equal(t, uint64(2), api.Metrics().Reconnects)
+}
+
+func TestMetricsHandler_PrometheusText(t *testing.T) {
+	api := newTestAPI(&fakeSocketManager{connected: true})
+	api.metrics.allocation(`GET /say"hi"`, OutcomeSent)
+	api.metrics.allocationLatency(0)
+	api.metrics.reconnect()
+	api.metrics.callChain()
+
+	w := httptest.NewRecorder()
+	api.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE usageflow_allocations_total counter\n")
+	assert.Contains(t, body, `usageflow_allocations_total{route="GET /say\"hi\"",outcome="sent"} 1`+"\n")
+	assert.Contains(t, body, `usageflow_allocation_duration_seconds_bucket{le="0.005"} 1`+"\n")
+	assert.Contains(t, body, `usageflow_allocation_duration_seconds_bucket{le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, "usageflow_reconnects_total 1\n")
+	assert.Contains(t, body, "usageflow_connections_up 1\n")
+	assert.Contains(t, body, `usageflow_queue_dropped_total{reason="evicted"} 0`+"\n")
+	assert.Contains(t, body, "usageflow_call_chain_reports_total 1\n")
+}
+
+func TestWriteMetrics_EmptySnapshot(t *testing.T) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, (&UsageFlowAPI{}).Metrics())
+	assert.Contains(t, buf.String(), "usageflow_allocation_duration_seconds_count 0\n")
+	assert.Contains(t, buf.String(), "usageflow_connections_up 0\n")
+}
@@ -1,18 +1,19 @@
 package middleware
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"log/slog"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/usageflow/usageflow-go-middleware/v2/internal/logging"
 	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
 	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
 	"github.com/usageflow/usageflow-go-middleware/v2/pkg/tracker"
@@ -20,13 +21,28 @@ import (
 
 type PolicyMap map[string]*config.ApplicationEndpointPolicy
 
-type socketManager interface {
-	Send(*socket.UsageFlowSocketMessage) error
-	SendAsync(*socket.UsageFlowSocketMessage) (*socket.UsageFlowSocketResponse, error)
+// Transport carries messages between the middleware and UsageFlow.
+// socket.UsageFlowSocketManager is the default implementation; use
+// WithTransport to wrap it (retries, logging) or to substitute a fake in
+// tests.
+type Transport interface {
+	// Send delivers a fire-and-forget message.
+	Send(msg *socket.UsageFlowSocketMessage) error
+	// SendAsyncContext sends msg and waits for the correlated response until
+	// ctx is done or the transport's own timeout elapses.
+	SendAsyncContext(ctx context.Context, msg *socket.UsageFlowSocketMessage) (*socket.UsageFlowSocketResponse, error)
+	// IsConnected reports whether messages can currently be delivered.
 	IsConnected() bool
+	// Close releases the transport's connections.
 	Close()
 }
 
+var (
+	_ Transport = (*socket.UsageFlowSocketManager)(nil)
+	_ Transport = (*socket.HTTPTransport)(nil)
+	_ Transport = (*socket.FallbackTransport)(nil)
+)
+
 type UsageFlowAPI struct {
 	APIKey                      string                     `json:"apiKey"`
 	ApplicationId               string                     `json:"applicationId"`
@@ -38,11 +54,16 @@ type UsageFlowAPI struct {
 	policyMap                   PolicyMap
 	mu                          sync.RWMutex
 	updaterOnce                 sync.Once
-	socketManager               socketManager
+	transport                   Transport
 	connected                   bool // Tracks socket connection status
 	monitoringPathsMap          map[string]map[string]bool
 	whitelistEndpointsMap       map[string]map[string]bool
 	localWhitelist              []config.Route
+	// monitoringRules and whitelistRules hold the wildcard and host- or
+	// header-scoped routes of the maps above, compiled when the maps are
+	// rebuilt. Scoped routes are only matched here.
+	monitoringRules routeRules
+	whitelistRules  routeRules
 	// reportAllFunctionAllocations meters every discovered function (JS default true).
 	reportAllFunctionAllocations bool
 	// accountReachLimit stops metering when the UsageFlow plan period cap is hit.
@@ -51,33 +72,106 @@ type UsageFlowAPI struct {
 	forceMonitorAll bool
 	// functionPolicies indexes FUNCTION strategies by "METHOD url func:path:name".
 	functionPolicies map[string]config.ApiConfigStrategy
+	// configRefreshInterval is the StartConfigUpdater polling period.
+	configRefreshInterval time.Duration
+	logger                *slog.Logger
+	// logLimit rate-limits per-request log events.
+	logLimit logging.Limiter
+	// inFlight counts metered requests that have not sent their fulfill
+	// event yet; Shutdown waits for it to reach zero.
+	inFlight atomic.Int64
+	// droppedEvents counts fire-and-forget metering events the transport
+	// rejected.
+	droppedEvents atomic.Int64
+	stopOnce      sync.Once
+	stopInit      sync.Once
+	stop          chan struct{}
+	// background tracks the config updater and spool replayer.
+	background sync.WaitGroup
+	// spool holds metering events while UsageFlow is unreachable (optional).
+	spool *socket.Spool
+	// budgets caps how long rate-limited requests wait on UsageFlow.
+	budgets latencyBudgets
+	// tracer starts spans around UsageFlow round trips (optional).
+	tracer Tracer
+	// pendingRefresh collects refreshTargets pushed by the server until the
+	// updater wakes up on refresh.
+	pendingRefresh atomic.Int32
+	refreshInit    sync.Once
+	refresh        chan struct{}
+	// configReady is closed once the first config fetch has finished.
+	configInit  sync.Once
+	configReady chan struct{}
+	// metrics backs Metrics and MetricsHandler.
+	metrics agentMetrics
+	// decisions keeps the latest decisions for DebugState.
+	decisions decisionLog
+	// decisionHook receives every decision (optional).
+	decisionHook func(Decision)
 }
 
 // New creates a new instance of UsageFlowAPI
 func New(apiKey string) *UsageFlowAPI {
-	socketManager := socket.NewUsageFlowSocketManager(apiKey)
+	return NewWithOptions(apiKey)
+}
+
+// NewWithOptions creates a UsageFlowAPI with a custom endpoint, pool size,
+// timeouts, refresh interval, logger or dialer. Unset options keep the
+// defaults used by New.
+func NewWithOptions(apiKey string, opts ...Option) *UsageFlowAPI {
+	o := newOptions(opts)
+	transport := o.transport
+	if transport == nil {
+		manager := socket.NewUsageFlowSocketManagerWithConfig(apiKey, o.socket)
+		transport = manager
+		if o.httpFallback != nil && o.httpFallback.URL == "" {
+			o.logger.Warn("usageflow: HTTP fallback disabled", "error", "no fallback URL configured")
+		} else if o.httpFallback != nil {
+			transport = socket.NewFallbackTransport(manager, socket.NewHTTPTransport(apiKey, *o.httpFallback), o.fallbackAfter)
+		}
+	}
 	api := &UsageFlowAPI{
 		policyMap:                    make(PolicyMap),
-		socketManager:                socketManager,
-		connected:                    socketManager.IsConnected(), // Initialize connection status
+		transport:                    transport,
+		connected:                    transport.IsConnected(), // Initialize connection status
 		reportAllFunctionAllocations: true,
 		functionPolicies:             make(map[string]config.ApiConfigStrategy),
+		configRefreshInterval:        o.configRefreshInterval,
+		logger:                       o.logger,
+		budgets:                      o.budgets,
+		tracer:                       o.tracer,
+		decisionHook:                 o.decisionHook,
+	}
+	if o.spool != nil {
+		spool, err := socket.OpenSpool(*o.spool)
+		if err != nil {
+			api.logger.Warn("usageflow: spool disabled", "dir", o.spool.Dir, "error", err)
+		} else {
+			api.spool = spool
+			api.startSpoolReplayer()
+		}
 	}
 	api.wireFunctionAllocationCallbacks()
+	api.subscribePushes()
+	api.subscribeUndelivered()
+	api.subscribeMetrics()
 	api.StartConfigUpdater()
 	return api
 }
 
 // Whitelist adds routes that bypass metering (merged with server whitelist on each config refresh).
+// URLs may use the same wildcards as the Console, e.g. "/internal/*", and
+// routes may be scoped with Host and Headers.
 func (u *UsageFlowAPI) Whitelist(routes ...config.Route) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 	u.localWhitelist = append(u.localWhitelist, routes...)
+	u.whitelistRules = u.whitelistRules.add(routes)
 	if u.whitelistEndpointsMap == nil {
 		u.whitelistEndpointsMap = make(map[string]map[string]bool)
 	}
 	for _, route := range routes {
-		if route.Method == "" || route.URL == "" {
+		if route.Method == "" || route.URL == "" || isScopedRoute(route) {
 			continue
 		}
 		if _, exists := u.whitelistEndpointsMap[route.Method]; !exists {
@@ -99,148 +193,196 @@ func (u *UsageFlowAPI) ForceMonitorAll() {
 // RequestInterceptor creates a Gin middleware for intercepting requests
 func (u *UsageFlowAPI) RequestInterceptor() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		method := c.Request.Method
-		url := GetPatternedURL(c)
+		u.interceptRequest(ginRequest{c: c})
+	}
+}
 
-		// Establish request-scoped tracking for Track/Wrap (fail soft).
-		trackingStore := u.beginTracking(c, method, url)
-		defer u.finishTracking(c, method, url, trackingStore)
+// interceptRequest runs the metering flow for one request. Framework
+// middlewares adapt their request type to requestContext and delegate here.
+func (u *UsageFlowAPI) interceptRequest(rc requestContext) {
+	u.inFlight.Add(1)
+	defer u.inFlight.Add(-1)
 
-		// Route maps are replaced during config refreshes and may also be updated
-		// by Whitelist, so evaluate both decisions under the same read lock.
-		u.mu.RLock()
-		whitelisted := isWhitelisted(method, url, u.whitelistEndpointsMap)
-		forceAll := u.forceMonitorAll
-		reachLimit := u.accountReachLimit
-		monitored := isRouteMonitored(method, url, u.monitoringPathsMap)
-		u.mu.RUnlock()
+	req := rc.Request()
+	method := req.Method
+	url := rc.RoutePattern()
 
-		if whitelisted {
-			c.Next()
-			return
-		}
+	// Establish request-scoped tracking for Track/Wrap (fail soft).
+	trackingStore := u.beginTracking(rc, method, url)
+	var traceID string
+	defer func() { u.finishTracking(method, url, traceID, trackingStore) }()
 
-		// Plan cap: stop metering, fail soft for the customer app.
-		if reachLimit {
-			c.Next()
-			return
-		}
+	// Route maps are replaced during config refreshes and may also be updated
+	// by Whitelist, so evaluate both decisions under the same read lock.
+	u.mu.RLock()
+	whitelisted := isWhitelisted(method, url, u.whitelistEndpointsMap) || u.whitelistRules.match(req, method, url)
+	forceAll := u.forceMonitorAll
+	reachLimit := u.accountReachLimit
+	monitored := isMonitored(req, method, url, u.monitoringPathsMap, u.monitoringRules)
+	u.mu.RUnlock()
 
-		// JS/Python parity: empty monitoringPaths => monitor all routes.
-		// ForceMonitorAll ignores remote monitoringPaths entirely.
-		if !forceAll && !monitored {
-			c.Next()
-			return
-		}
+	if whitelisted {
+		u.decide(rc, Decision{}, OutcomeWhitelisted, nil)
+		rc.Next()
+		return
+	}
 
-		//Capture the time before the request is processed
-		startTime := time.Now()
-		usageflowRequestId := uuid.New().String()
-		c.Set("usageflowStartTime", startTime)
-		tracker.SetUsageflowRequestID(c.Request.Context(), usageflowRequestId)
+	// Plan cap: stop metering, fail soft for the customer app.
+	if reachLimit {
+		u.decide(rc, Decision{}, OutcomePlanCap, nil)
+		rc.Next()
+		return
+	}
 
-		// Process request with UsageFlow logic
-		metadata := u.collectRequestMetadata(c)
-		metadata["usageflowRequestId"] = usageflowRequestId
-		ledgerId := u.GuessLedgerId(c)
-		userIdentifierSuffix, rateLimited := u.GetUserPrefix(c, method, url)
+	// JS/Python parity: empty monitoringPaths => monitor all routes.
+	// ForceMonitorAll ignores remote monitoringPaths entirely.
+	if !forceAll && !monitored {
+		u.decide(rc, Decision{}, OutcomeNotMonitored, nil)
+		rc.Next()
+		return
+	}
 
-		if userIdentifierSuffix != "" {
-			ledgerId = fmt.Sprintf("%s %s", ledgerId, userIdentifierSuffix)
-		}
+	//Capture the time before the request is processed
+	startTime := time.Now()
+	usageflowRequestId := uuid.New().String()
+	rc.Set("usageflowStartTime", startTime)
+	tracker.SetUsageflowRequestID(rc.Request().Context(), usageflowRequestId)
 
-		success, err := u.ExecuteRequestWithMetadata(ledgerId, method, url, metadata, c, rateLimited)
-		if field := u.lookupAPIResponseTrackingField(method, url); field != "" {
-			c.Set("responseTrackingField", field)
-		}
-		if err != nil {
-			errorMessage := err.Error()
-			if errorMessage == "endpoints is blocked" {
-				c.AbortWithStatusJSON(403, gin.H{"error": "endpoint_blocked", "message": "UsageFlow blocked this endpoint by policy rule."})
-				return
-			}
+	// Process request with UsageFlow logic
+	metadata := u.collectRequestMetadata(rc)
+	metadata["usageflowRequestId"] = usageflowRequestId
+	ledgerId := u.guessLedgerId(rc)
+	policy, userIdentifierSuffix, rateLimited := u.matchPolicy(rc, method, url)
 
-			// Real quota/policy denials fail closed. UsageFlow outages
-			// (disconnected socket / transport errors) fail open so customer
-			// APIs stay up; rate limits resume when the agent reconnects.
-			if rateLimited && !isUsageFlowAvailabilityError(err) {
-				c.AbortWithStatusJSON(429, gin.H{"error": "rate_limit_exceeded", "message": "UsageFlow could not authorize this rate-limited request."})
-				return
-			}
-			if rateLimited {
-				c.Next()
-				return
-			}
+	if userIdentifierSuffix != "" {
+		ledgerId = fmt.Sprintf("%s %s", ledgerId, userIdentifierSuffix)
+	}
+	matched := Decision{Alias: ledgerId, Identity: userIdentifierSuffix, Policy: policy}
+	if traceID = u.traceRequest(rc, usageflowRequestId, ledgerId); traceID != "" {
+		metadata["traceId"] = traceID
+	}
 
-			// Non-rate-limited metering remains fail-open.
-			u.mu.RLock()
-			connected := u.connected
-			u.mu.RUnlock()
-			if !connected {
-				c.Next()
-				return
-			}
+	spanCtx, span := u.startSpan(rc.Request().Context(), SpanAllocate)
+	span.SetAttribute(AttributeRequestID, usageflowRequestId)
+	span.SetAttribute(AttributeAlias, ledgerId)
+	span.SetAttribute(AttributeRateLimited, rateLimited)
+	success, err := u.executeRequest(spanCtx, ledgerId, metadata, rc, rateLimited)
+	if id, ok := rc.Get("eventId"); ok && id != "" {
+		span.SetAttribute(AttributeAllocationID, id)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	if field := u.lookupAPIResponseTrackingField(method, url); field != "" {
+		rc.Set("responseTrackingField", field)
+	}
+	if err != nil {
+		errorMessage := err.Error()
+		if errorMessage == "endpoints is blocked" {
+			u.decide(rc, matched, OutcomeBlocked, err)
+			u.logEvent(slog.LevelInfo, "usageflow: endpoint blocked by policy", "route", method+" "+url, "alias", ledgerId)
+			rc.AbortWithJSON(403, map[string]interface{}{"error": "endpoint_blocked", "message": "UsageFlow blocked this endpoint by policy rule."})
+			return
+		}
 
-			c.AbortWithStatusJSON(429, gin.H{"error": "rate_limit_exceeded", "message": "UsageFlow blocked this request because the rate limit or quota was exceeded."})
+		// Real quota/policy denials fail closed. UsageFlow outages
+		// (disconnected socket / transport errors) fail open so customer
+		// APIs stay up; rate limits resume when the agent reconnects.
+		if rateLimited && !isUsageFlowAvailabilityError(err) {
+			u.decide(rc, matched, OutcomeDenied, err)
+			u.logEvent(slog.LevelInfo, "usageflow: allocation denied", "route", method+" "+url, "alias", ledgerId, "error", err)
+			rc.AbortWithJSON(429, map[string]interface{}{"error": "rate_limit_exceeded", "message": "UsageFlow could not authorize this rate-limited request."})
 			return
 		}
-		if !success {
-			// If socket is not connected, continue normally instead of aborting
-			u.mu.RLock()
-			connected := u.connected
-			u.mu.RUnlock()
-			if !connected {
-				c.Next()
-				return
-			}
-			c.AbortWithStatusJSON(400, gin.H{"error": "Request allocation failed"})
+		if rateLimited {
+			u.decide(rc, matched, OutcomeFailedOpen, err)
+			u.logEvent(slog.LevelWarn, "usageflow: allocation failed, serving request unmetered", "route", method+" "+url, "alias", ledgerId, "error", err)
+			rc.Next()
 			return
 		}
 
-		// Process the original request (capture body for responseSchema / metering).
-		blw := attachBodyCapture(c)
-		c.Next()
-
-		// After the request is processed, execute the fulfill request
-		metadata["responseStatusCode"] = c.Writer.Status()
+		// Non-rate-limited metering remains fail-open.
+		u.mu.RLock()
+		connected := u.connected
+		u.mu.RUnlock()
+		if !connected {
+			u.decide(rc, matched, OutcomeFailedOpen, err)
+			u.logEvent(slog.LevelWarn, "usageflow: allocation failed, serving request unmetered", "route", method+" "+url, "alias", ledgerId, "error", err)
+			rc.Next()
+			return
+		}
 
-		responseTrackingField := ""
-		if field, ok := c.Get("responseTrackingField"); ok {
-			if s, ok := field.(string); ok {
-				responseTrackingField = s
-			}
+		u.decide(rc, matched, OutcomeDenied, err)
+		u.logEvent(slog.LevelInfo, "usageflow: allocation denied", "route", method+" "+url, "alias", ledgerId, "error", err)
+		rc.AbortWithJSON(429, map[string]interface{}{"error": "rate_limit_exceeded", "message": "UsageFlow blocked this request because the rate limit or quota was exceeded."})
+		return
+	}
+	if !success {
+		// If socket is not connected, continue normally instead of aborting
+		u.mu.RLock()
+		connected := u.connected
+		u.mu.RUnlock()
+		if !connected {
+			u.decide(rc, matched, OutcomeFailedOpen, nil)
+			rc.Next()
+			return
 		}
-		amount := enrichFulfillMetadataWithResponse(metadata, blw, responseTrackingField)
-		c.Set("usageflowAmount", amount)
+		u.decide(rc, matched, OutcomeDenied, nil)
+		u.logEvent(slog.LevelError, "usageflow: allocation rejected", "route", method+" "+url, "alias", ledgerId)
+		rc.AbortWithJSON(400, map[string]interface{}{"error": "Request allocation failed"})
+		return
+	}
+
+	// An empty allocation ID means UsageFlow was unavailable or over
+	// budget and the request goes through unmetered.
+	if id, _ := rc.Get("eventId"); id == "" {
+		u.decide(rc, matched, OutcomeFailedOpen, nil)
+	} else {
+		u.decide(rc, matched, OutcomeSent, nil)
+	}
+
+	// Process the original request (capture body for responseSchema / metering).
+	capture := rc.CaptureResponse()
+	rc.Next()
+
+	// After the request is processed, execute the fulfill request
+	metadata["responseStatusCode"] = rc.Status()
 
-		if _, err := u.ExecuteFulfillRequestWithMetadata(ledgerId, method, url, metadata, c); err != nil {
-			// Fail soft after the handler already completed.
-			_ = err
+	responseTrackingField := ""
+	if field, ok := rc.Get("responseTrackingField"); ok {
+		if s, ok := field.(string); ok {
+			responseTrackingField = s
 		}
 	}
+	amount := enrichFulfillMetadataWithResponse(metadata, capture, responseTrackingField)
+	rc.Set("usageflowAmount", amount)
+	u.activeSpan(rc).SetAttribute(AttributeAmount, amount)
+
+	if _, err := u.executeFulfillRequest(ledgerId, metadata, rc); err != nil {
+		// Fail soft after the handler already completed.
+		allocationID, _ := rc.Get("eventId")
+		u.logEvent(slog.LevelWarn, "usageflow: failed to send fulfill event", "route", method+" "+url, "alias", ledgerId, "allocation_id", allocationID, "error", err)
+	}
 }
 
 // beginTracking attaches a per-request tracking context when discovery is enabled.
-func (u *UsageFlowAPI) beginTracking(c *gin.Context, method, url string) *tracker.TrackingContext {
-	defer func() {
-		_ = recover()
-	}()
+func (u *UsageFlowAPI) beginTracking(rc requestContext, method, url string) *tracker.TrackingContext {
+	defer u.recoverPanic("beginTracking")
 	if !tracker.IsEnabled() {
 		return nil
 	}
-	ctx, store := tracker.WithTracking(c.Request.Context(), &tracker.RequestContext{
+	ctx, store := tracker.WithTracking(rc.Request().Context(), &tracker.RequestContext{
 		Method: method,
 		URL:    url,
 	}, "")
-	c.Request = c.Request.WithContext(ctx)
+	rc.SetRequest(rc.Request().WithContext(ctx))
 	return store
 }
 
 // finishTracking sends report_call_chain after the handler (fail soft).
-func (u *UsageFlowAPI) finishTracking(c *gin.Context, method, url string, store *tracker.TrackingContext) {
-	defer func() {
-		_ = recover()
-	}()
+func (u *UsageFlowAPI) finishTracking(method, url, traceID string, store *tracker.TrackingContext) {
+	defer u.recoverPanic("finishTracking")
 	if store == nil || !tracker.IsEnabled() {
 		return
 	}
@@ -248,18 +390,17 @@ func (u *UsageFlowAPI) finishTracking(c *gin.Context, method, url string, store
 	if len(callChain) == 0 {
 		return
 	}
-	u.reportCallChain(method, url, store.RequestID(), callChain)
+	u.reportCallChain(method, url, store.RequestID(), traceID, callChain)
 }
 
 // reportCallChain sends the call chain over the WebSocket when connected.
-func (u *UsageFlowAPI) reportCallChain(method, url, usageflowRequestID string, callChain []tracker.FunctionCallRecord) {
-	defer func() {
-		_ = recover()
-	}()
-	if len(callChain) == 0 || !u.isConnected() {
+func (u *UsageFlowAPI) reportCallChain(method, url, usageflowRequestID, traceID string, callChain []tracker.FunctionCallRecord) {
+	defer u.recoverPanic("reportCallChain")
+	if len(callChain) == 0 || (!u.isConnected() && u.spool == nil) {
 		return
 	}
-	_ = u.socketManager.Send(&socket.UsageFlowSocketMessage{
+	u.metrics.callChain()
+	u.sendEvent(&socket.UsageFlowSocketMessage{
 		Type: "report_call_chain",
 		Payload: &socket.ReportCallChainPayload{
 			Method:             method,
@@ -267,12 +408,13 @@ func (u *UsageFlowAPI) reportCallChain(method, url, usageflowRequestID string, c
 			CallChain:          callChain,
 			Timestamp:          time.Now().UTC().Format(time.RFC3339),
 			UsageflowRequestID: usageflowRequestID,
+			TraceID:            traceID,
 		},
 	})
 }
 
 func (u *UsageFlowAPI) FetchApiConfig() ([]config.ApiConfigStrategy, error) {
-	response, err := u.socketManager.SendAsync(&socket.UsageFlowSocketMessage{
+	response, err := u.transport.SendAsyncContext(context.Background(), &socket.UsageFlowSocketMessage{
 		Type: "get_application_policies",
 	})
 
@@ -317,7 +459,7 @@ func (u *UsageFlowAPI) FetchApiConfig() ([]config.ApiConfigStrategy, error) {
 }
 
 func (u *UsageFlowAPI) FetchApplicationConfig() (config.ApplicationConfigResponse, error) {
-	response, err := u.socketManager.SendAsync(&socket.UsageFlowSocketMessage{
+	response, err := u.transport.SendAsyncContext(context.Background(), &socket.UsageFlowSocketMessage{
 		Type: "get_application_config",
 	})
 
@@ -376,6 +518,8 @@ func (u *UsageFlowAPI) applyRouteConfig(applicationConfigResponse config.Applica
 
 	u.monitoringPathsMap = routesToMap(u.MonitoringPaths)
 	u.whitelistEndpointsMap = routesToMap(u.WhitelistEndpoints, u.localWhitelist)
+	u.monitoringRules = compileRouteRules(u.MonitoringPaths)
+	u.whitelistRules = compileRouteRules(u.WhitelistEndpoints, u.localWhitelist)
 
 	if applicationConfigResponse.ReportAllFunctionAllocations != nil {
 		u.reportAllFunctionAllocations = *applicationConfigResponse.ReportAllFunctionAllocations
@@ -387,11 +531,13 @@ func (u *UsageFlowAPI) applyRouteConfig(applicationConfigResponse config.Applica
 	return nil
 }
 
+// routesToMap indexes routes by method and URL. Host- and header-scoped
+// routes are left to the compiled route rules.
 func routesToMap(routeSets ...[]config.Route) map[string]map[string]bool {
 	routesMap := make(map[string]map[string]bool)
 	for _, routes := range routeSets {
 		for _, route := range routes {
-			if route.Method == "" || route.URL == "" {
+			if route.Method == "" || route.URL == "" || isScopedRoute(route) {
 				continue
 			}
 			if routesMap[route.Method] == nil {
@@ -404,12 +550,12 @@ func routesToMap(routeSets ...[]config.Route) map[string]map[string]bool {
 }
 
 func (u *UsageFlowAPI) FetchBlockedEndpoints() error {
-	response, err := u.socketManager.SendAsync(&socket.UsageFlowSocketMessage{
+	response, err := u.transport.SendAsyncContext(context.Background(), &socket.UsageFlowSocketMessage{
 		Type: "get_blocked_endpoints",
 	})
 
 	if err != nil {
-		return nil
+		return err
 	}
 
 	// Convert the response payload to BlockedEndpoints
@@ -456,13 +602,16 @@ func (u *UsageFlowAPI) FetchBlockedEndpoints() error {
 	return nil
 }
 
-func (u *UsageFlowAPI) allocateRequest(ledgerId string, amount *float64, metadata map[string]interface{}, rateLimited bool) (string, error) {
+// allocateRequest reserves a unit for ledgerId. Rate-limited allocations wait
+// for the server's answer until ctx is done.
+func (u *UsageFlowAPI) allocateRequest(ctx context.Context, ledgerId string, amount *float64, metadata map[string]interface{}, rateLimited bool) (string, error) {
 	// Check if socket is connected (this updates the status)
 	connected := u.isConnected()
 
 	// Availability outage: never take down the customer API. Metering and
-	// rate limits resume when the WebSocket reconnects.
-	if !connected {
+	// rate limits resume when the WebSocket reconnects; with a spool,
+	// non-rate-limited events are kept and replayed after reconnect.
+	if !connected && (rateLimited || u.spool == nil) {
 		return "", nil
 	}
 
@@ -487,7 +636,7 @@ func (u *UsageFlowAPI) allocateRequest(ledgerId string, amount *float64, metadat
 		allocationId := uuid.New().String()
 		payload.AllocationID = &allocationId
 
-		u.socketManager.Send(&socket.UsageFlowSocketMessage{
+		u.sendEvent(&socket.UsageFlowSocketMessage{
 			Type:    "request_for_allocation",
 			Payload: payload,
 		})
@@ -495,15 +644,18 @@ func (u *UsageFlowAPI) allocateRequest(ledgerId string, amount *float64, metadat
 		return allocationId, nil
 	}
 
-	response, err := u.socketManager.SendAsync(&socket.UsageFlowSocketMessage{
+	response, err := u.transport.SendAsyncContext(ctx, &socket.UsageFlowSocketMessage{
 		Type:    "request_for_allocation",
 		Payload: payload,
 	})
 	if err != nil {
-		// Update connection status on error
-		u.mu.Lock()
-		u.connected = false
-		u.mu.Unlock()
+		// A canceled request or an exhausted latency budget is not an outage.
+		if ctx.Err() == nil {
+			// Update connection status on error
+			u.mu.Lock()
+			u.connected = false
+			u.mu.Unlock()
+		}
 		// Transport failure = UsageFlow unavailable → fail open.
 		return "", nil
 	}
@@ -534,12 +686,14 @@ func (u *UsageFlowAPI) allocateRequest(ledgerId string, amount *float64, metadat
 	return allocationId, nil
 }
 
-func (u *UsageFlowAPI) useAllocationRequest(ledgerId string, amount *float64, allocationId string, metadata map[string]interface{}, rateLimited bool) (bool, error) {
+// useAllocationRequest settles allocationId. Rate-limited settlements wait for
+// confirmation until ctx is done.
+func (u *UsageFlowAPI) useAllocationRequest(ctx context.Context, ledgerId string, amount *float64, allocationId string, metadata map[string]interface{}, rateLimited bool) (bool, error) {
 	// Check if socket is connected
 	connected := u.isConnected()
 
 	// Availability outage: allow the request through.
-	if !connected {
+	if !connected && (rateLimited || u.spool == nil) {
 		return true, nil
 	}
 
@@ -563,14 +717,16 @@ func (u *UsageFlowAPI) useAllocationRequest(ledgerId string, amount *float64, al
 	}
 
 	if rateLimited {
-		response, err := u.socketManager.SendAsync(&socket.UsageFlowSocketMessage{
+		response, err := u.transport.SendAsyncContext(ctx, &socket.UsageFlowSocketMessage{
 			Type:    "use_allocation",
 			Payload: payload,
 		})
 		if err != nil {
-			u.mu.Lock()
-			u.connected = false
-			u.mu.Unlock()
+			if ctx.Err() == nil {
+				u.mu.Lock()
+				u.connected = false
+				u.mu.Unlock()
+			}
 			// Transport failure = UsageFlow unavailable → fail open.
 			return true, nil
 		}
@@ -588,7 +744,7 @@ func (u *UsageFlowAPI) useAllocationRequest(ledgerId string, amount *float64, al
 		return true, nil
 	}
 
-	u.socketManager.Send(&socket.UsageFlowSocketMessage{
+	u.sendEvent(&socket.UsageFlowSocketMessage{
 		Type:    "use_allocation",
 		Payload: payload,
 	})
@@ -619,17 +775,32 @@ func isUsageFlowAvailabilityError(err error) bool {
 
 // ExecuteRequestWithMetadata executes the initial allocation request
 func (u *UsageFlowAPI) ExecuteRequestWithMetadata(ledgerId, method, url string, metadata map[string]interface{}, c *gin.Context, rateLimited bool) (bool, error) {
+	return u.executeRequest(c.Request.Context(), ledgerId, metadata, ginRequest{c: c}, rateLimited)
+}
+
+// executeRequest allocates on a child of ctx, which is the request context
+// or a span started from it.
+func (u *UsageFlowAPI) executeRequest(ctx context.Context, ledgerId string, metadata map[string]interface{}, rc requestContext, rateLimited bool) (bool, error) {
+	// Pre-handler round trips stop waiting when the client goes away or the
+	// route's latency budget runs out; both fail open.
+	ctx, cancel := u.budgetContext(ctx, rc.Request(), rc.RoutePattern())
+	defer cancel()
+
 	amount := float64(1)
-	allocationId, err := u.allocateRequest(ledgerId, &amount, metadata, rateLimited)
+	start := time.Now()
+	allocationId, err := u.allocateRequest(ctx, ledgerId, &amount, metadata, rateLimited)
+	if rateLimited {
+		u.metrics.allocationLatency(time.Since(start))
+	}
 	if err != nil {
 		return false, err
 	}
 
-	c.Set("eventId", allocationId)
-	c.Set("rateLimited", rateLimited)
+	rc.Set("eventId", allocationId)
+	rc.Set("rateLimited", rateLimited)
 
 	// Propagate HTTP allocation context so function-level metering can correlate.
-	if store := tracker.FromContext(c.Request.Context()); store != nil {
+	if store := tracker.FromContext(rc.Request().Context()); store != nil {
 		metaCopy := make(map[string]interface{}, len(metadata))
 		for k, v := range metadata {
 			metaCopy[k] = v
@@ -638,17 +809,17 @@ func (u *UsageFlowAPI) ExecuteRequestWithMetadata(ledgerId, method, url string,
 	}
 
 	// Rate limits protect handler execution, so settle the default request unit
-	// synchronously before c.Next(). The post-handler fulfill path is reserved
-	// for non-rate-limited or response-derived metering.
+	// synchronously before the handler runs. The post-handler fulfill path is
+	// reserved for non-rate-limited or response-derived metering.
 	if rateLimited {
-		success, err := u.useAllocationRequest(ledgerId, &amount, allocationId, metadata, true)
+		success, err := u.useAllocationRequest(ctx, ledgerId, &amount, allocationId, metadata, true)
 		if err != nil {
 			return false, err
 		}
 		if !success {
 			return false, fmt.Errorf("rate-limit settlement failed")
 		}
-		c.Set("usageflowSettledBeforeHandler", true)
+		rc.Set("usageflowSettledBeforeHandler", true)
 	}
 
 	return true, nil
@@ -656,8 +827,8 @@ func (u *UsageFlowAPI) ExecuteRequestWithMetadata(ledgerId, method, url string,
 
 func (u *UsageFlowAPI) isConnected() bool {
 	// Always check the actual connection status from socket manager
-	if u.socketManager != nil {
-		connected := u.socketManager.IsConnected()
+	if u.transport != nil {
+		connected := u.transport.IsConnected()
 		u.mu.Lock()
 		u.connected = connected
 		u.mu.Unlock()
@@ -676,9 +847,135 @@ func (u *UsageFlowAPI) IsConnected() bool {
 	return u.isConnected()
 }
 
+// sendEvent sends a fire-and-forget metering event. With a spool, events
+// raised while disconnected are spooled instead, as are events raised while
+// earlier ones wait for replay, so settlements never overtake their
+// allocations. Events the transport rejects are spooled when possible and
+// counted as dropped otherwise.
+func (u *UsageFlowAPI) sendEvent(msg *socket.UsageFlowSocketMessage) {
+	if u.spool != nil && (u.spool.Len() > 0 || !u.isConnected()) && u.spoolEvent(msg) {
+		return
+	}
+	if err := u.transport.Send(msg); err != nil {
+		u.spoolOrDrop(msg, err)
+	}
+}
+
+// spoolOrDrop spools an event the transport failed to deliver, or counts it
+// as dropped.
+func (u *UsageFlowAPI) spoolOrDrop(msg *socket.UsageFlowSocketMessage, err error) {
+	if u.spoolEvent(msg) {
+		return
+	}
+	u.droppedEvents.Add(1)
+	u.logEvent(slog.LevelWarn, "usageflow: dropped metering event", "type", msg.Type, "error", err)
+}
+
+// stopCh returns the channel closed by Shutdown. It is created lazily so
+// zero-value and test-built instances can be shut down too.
+func (u *UsageFlowAPI) stopCh() chan struct{} {
+	u.stopInit.Do(func() {
+		u.stop = make(chan struct{})
+	})
+	return u.stop
+}
+
+// Shutdown stops configuration refreshes, waits for in-flight requests to
+// send their metering events until ctx is done, then closes the UsageFlow
+// connections, waiting for that until ctx is done as well. It returns the
+// number of metering events that were not delivered so far: sends the
+// transport rejected or dropped from its outbound queue. Requests still in
+// flight at the deadline are logged, not counted. The error is ctx.Err()
+// when the deadline cut the drain or the close short.
+//
+// Requests arriving after Shutdown are served without metering.
+func (u *UsageFlowAPI) Shutdown(ctx context.Context) (int, error) {
+	u.stopOnce.Do(func() {
+		close(u.stopCh())
+	})
+
+	var err error
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for u.inFlight.Load() > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if pending := u.inFlight.Load(); pending > 0 {
+		u.log().Warn("usageflow: shutdown deadline reached with requests still being metered", "requests", pending)
+	}
+
+	// Closing flushes batches and outbound queues, which can outlast ctx;
+	// stop waiting for it at the deadline.
+	if u.transport != nil {
+		closed := make(chan struct{})
+		go func() {
+			u.transport.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if u.spool != nil {
+		if closeErr := u.spool.Close(); closeErr != nil {
+			u.log().Warn("usageflow: failed to close spool", "error", closeErr)
+		}
+	}
+	u.mu.Lock()
+	u.connected = false
+	u.mu.Unlock()
+
+	if err == nil {
+		updaterDone := make(chan struct{})
+		go func() {
+			u.background.Wait()
+			close(updaterDone)
+		}()
+		select {
+		case <-updaterDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	dropped := u.droppedEvents.Load()
+	// Transports that report lost events have had them spooled or counted
+	// in droppedEvents already.
+	if _, ok := u.transport.(undeliveredSource); !ok {
+		lost := u.QueueStats()
+		dropped += int64(lost.Evicted + lost.Undelivered)
+	}
+	return int(dropped), err
+}
+
+// queueStatser is implemented by transports with an outbound queue, such as
+// socket.UsageFlowSocketManager.
+type queueStatser interface {
+	QueueStats() socket.QueueStats
+}
+
+// QueueStats reports the transport's outbound queue depth and drop counters
+// (see WithOutboundQueue). It is zero for transports without a queue.
+func (u *UsageFlowAPI) QueueStats() socket.QueueStats {
+	if q, ok := u.transport.(queueStatser); ok {
+		return q.QueueStats()
+	}
+	return socket.QueueStats{}
+}
+
 // ExecuteFulfillRequestWithMetadata executes the fulfill request after the main request is processed
 func (u *UsageFlowAPI) ExecuteFulfillRequestWithMetadata(ledgerId, method, url string, metadata map[string]interface{}, c *gin.Context) (bool, error) {
-	if settled, ok := c.Get("usageflowSettledBeforeHandler"); ok {
+	return u.executeFulfillRequest(ledgerId, metadata, ginRequest{c: c})
+}
+
+func (u *UsageFlowAPI) executeFulfillRequest(ledgerId string, metadata map[string]interface{}, rc requestContext) (bool, error) {
+	if settled, ok := rc.Get("usageflowSettledBeforeHandler"); ok {
 		if settledBeforeHandler, ok := settled.(bool); ok && settledBeforeHandler {
 			return true, nil
 		}
@@ -687,19 +984,20 @@ func (u *UsageFlowAPI) ExecuteFulfillRequestWithMetadata(ledgerId, method, url s
 	// Check if socket is connected
 	connected := u.isConnected()
 
-	// If not connected, skip and return success (continue normally)
-	if !connected {
+	// If not connected, skip and return success (continue normally) unless
+	// the settlement can be spooled.
+	if !connected && u.spool == nil {
 		return true, nil
 	}
 
-	allocationId, exists := c.Get("eventId")
+	allocationId, exists := rc.Get("eventId")
 	if !exists {
 		// No allocation ID means we skipped allocation (socket was not connected)
 		// Return success to continue normally
 		return true, nil
 	}
 
-	startTime, exists := c.Get("usageflowStartTime")
+	startTime, exists := rc.Get("usageflowStartTime")
 	if !exists {
 		// No start time, but continue normally
 		return true, nil
@@ -708,41 +1006,54 @@ func (u *UsageFlowAPI) ExecuteFulfillRequestWithMetadata(ledgerId, method, url s
 
 	metadata["requestDuration"] = requestDuration.Milliseconds()
 
-	rateLimited, _ := c.Get("rateLimited")
+	rateLimited, _ := rc.Get("rateLimited")
 	isRateLimited, ok := rateLimited.(bool)
 	if !ok {
 		isRateLimited = false
 	}
 
 	amount := float64(1)
-	if v, ok := c.Get("usageflowAmount"); ok {
+	if v, ok := rc.Get("usageflowAmount"); ok {
 		if n, ok := v.(float64); ok {
 			amount = n
 		}
 	}
 
-	success, err := u.useAllocationRequest(ledgerId, &amount, allocationId.(string), metadata, isRateLimited)
+	// The handler already ran, so settle even if the client has gone away.
+	ctx := context.WithoutCancel(rc.Request().Context())
+	ctx, span := u.startSpan(ctx, SpanSettle)
+	span.SetAttribute(AttributeRequestID, metadata["usageflowRequestId"])
+	span.SetAttribute(AttributeAlias, ledgerId)
+	span.SetAttribute(AttributeAllocationID, allocationId)
+	span.SetAttribute(AttributeAmount, amount)
+	success, err := u.useAllocationRequest(ctx, ledgerId, &amount, allocationId.(string), metadata, isRateLimited)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
 	if err != nil {
 		// On error, return success to continue normally
+		u.logEvent(slog.LevelWarn, "usageflow: settlement failed", "alias", ledgerId, "allocation_id", allocationId, "error", err)
 		return true, nil
 	}
 	return success, nil
 }
 
 // collectRequestMetadata gathers metadata from the request
-func (u *UsageFlowAPI) collectRequestMetadata(c *gin.Context) map[string]interface{} {
+func (u *UsageFlowAPI) collectRequestMetadata(rc requestContext) map[string]interface{} {
+	req := rc.Request()
 	metadata := map[string]interface{}{
 		"applicationId": u.ApplicationId,
-		"method":        c.Request.Method,
-		"url":           GetPatternedURL(c), // Route pattern
-		"rawUrl":        c.Request.URL.Path, // Raw URL
-		"clientIP":      c.ClientIP(),
-		"userAgent":     c.GetHeader("User-Agent"),
+		"method":        req.Method,
+		"url":           rc.RoutePattern(), // Route pattern
+		"rawUrl":        req.URL.Path,      // Raw URL
+		"clientIP":      rc.ClientIP(),
+		"userAgent":     req.Header.Get("User-Agent"),
 		"timestamp":     time.Now().Format(time.RFC3339),
 	}
 
 	// Collect headers
-	headers := c.Request.Header
+	headers := req.Header
 	if len(headers) > 0 {
 		// Create a copy of headers to avoid modifying the original
 		sanitizedHeaders := make(map[string][]string)
@@ -781,35 +1092,25 @@ func (u *UsageFlowAPI) collectRequestMetadata(c *gin.Context) map[string]interfa
 
 	// Collect query parameters
 	queryParams := make(map[string]string)
-	for k, v := range c.Request.URL.Query() {
+	for k, v := range req.URL.Query() {
 		if len(v) > 0 {
 			queryParams[k] = v[0]
 		}
 	}
 	metadata["queryParams"] = queryParams
 
-	if params := c.Params; len(params) > 0 {
-		paramsMap := make(map[string]string)
-		for _, param := range params {
-			paramsMap[param.Key] = param.Value
-		}
-		metadata["pathParams"] = paramsMap
+	if params := rc.Params(); len(params) > 0 {
+		metadata["pathParams"] = params
 	}
 
-	// Collect request body if present
-	if c.Request.Body != nil && c.Request.Body != http.NoBody {
-		bodyBytes, err := io.ReadAll(c.Request.Body)
-		if err == nil {
-			// Restore the body for further processing
-			c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-
-			// Try to parse as JSON — store as requestBody (Console expects body = response).
-			var bodyJSON interface{}
-			if err := json.Unmarshal(bodyBytes, &bodyJSON); err == nil {
-				metadata["requestBody"] = bodyJSON
-			} else {
-				metadata["requestBody"] = string(bodyBytes)
-			}
+	// Collect request body if present (readRequestBody restores it for the handler).
+	if bodyBytes, err := readRequestBody(rc); err == nil && bodyBytes != nil {
+		// Try to parse as JSON — store as requestBody (Console expects body = response).
+		var bodyJSON interface{}
+		if err := json.Unmarshal(bodyBytes, &bodyJSON); err == nil {
+			metadata["requestBody"] = bodyJSON
+		} else {
+			metadata["requestBody"] = string(bodyBytes)
 		}
 	}
 
@@ -818,12 +1119,11 @@ func (u *UsageFlowAPI) collectRequestMetadata(c *gin.Context) map[string]interfa
 
 // GuessLedgerId attempts to extract a ledger ID from various sources
 func (u *UsageFlowAPI) GuessLedgerId(c *gin.Context) string {
-	// Try to get from header
-
-	method := c.Request.Method
-	url := GetPatternedURL(c)
+	return u.guessLedgerId(ginRequest{c: c})
+}
 
-	return fmt.Sprintf("%s %s", method, url)
+func (u *UsageFlowAPI) guessLedgerId(rc requestContext) string {
+	return fmt.Sprintf("%s %s", rc.Request().Method, rc.RoutePattern())
 }
 
 func isWhitelisted(method, url string, whiteListMap map[string]map[string]bool) bool {
@@ -869,23 +1169,34 @@ func isRouteMonitored(method, url string, routesMap map[string]map[string]bool)
 
 // GetUserPrefix attempts to extract a user identifier prefix based on the API configuration
 func (u *UsageFlowAPI) GetUserPrefix(c *gin.Context, method, url string) (string, bool) {
+	return u.getUserPrefix(ginRequest{c: c}, method, url)
+}
+
+func (u *UsageFlowAPI) getUserPrefix(rc requestContext, method, url string) (string, bool) {
+	_, identity, rateLimited := u.matchPolicy(rc, method, url)
+	return identity, rateLimited
+}
+
+// matchPolicy finds the API policy for method and url and resolves the
+// request's identity from it. policy is the strategy the identity came from,
+// or the first matching one when no identity was found; nil if none match.
+func (u *UsageFlowAPI) matchPolicy(rc requestContext, method, url string) (policy *config.ApiConfigStrategy, identity string, rateLimited bool) {
+	req := rc.Request()
 	u.mu.RLock()
-	config := u.ApiConfig
+	policies := u.ApiConfig
 	u.mu.RUnlock()
 
-	if config == nil {
-		return "", false
+	if policies == nil {
+		return nil, "", false
 	}
 
 	var identifier string
-	var rateLimited bool
-	var matched bool
 
 	// Find matching config for current method and url.
 	// FUNCTION policies share method+url with the parent route but must not
 	// drive HTTP identity/rate-limit — that made endpoint requests fail-closed
 	// whenever a function policy had hasRateLimit (USA-62 / Fivicon).
-	for _, cfg := range config {
+	for i, cfg := range policies {
 		if strings.EqualFold(cfg.Type, "FUNCTION") {
 			continue
 		}
@@ -893,7 +1204,9 @@ func (u *UsageFlowAPI) GetUserPrefix(c *gin.Context, method, url string) (string
 		if cfg.Method != method || cfg.Url != url {
 			continue
 		}
-		matched = true
+		if policy == nil {
+			policy = &policies[i]
+		}
 		if cfg.HasRateLimit {
 			rateLimited = true
 		}
@@ -906,29 +1219,26 @@ func (u *UsageFlowAPI) GetUserPrefix(c *gin.Context, method, url string) (string
 		// If no matching policy found or no identifier from policy, fall back to base config
 		switch *cfg.IdentityFieldLocation {
 		case "headers":
-			identifier = c.GetHeader(*cfg.IdentityFieldName)
+			identifier = req.Header.Get(*cfg.IdentityFieldName)
 		case "query":
-			identifier = c.Query(*cfg.IdentityFieldName)
+			identifier = req.URL.Query().Get(*cfg.IdentityFieldName)
 		case "path_params":
-			identifier = c.Param(*cfg.IdentityFieldName)
+			identifier = rc.Param(*cfg.IdentityFieldName)
 		case "query_params":
-			identifier = c.Query(*cfg.IdentityFieldName)
+			identifier = req.URL.Query().Get(*cfg.IdentityFieldName)
 		case "body":
+			// readRequestBody restores the body for further processing.
 			var bodyMap map[string]interface{}
-			if err := c.ShouldBindJSON(&bodyMap); err == nil {
+			if body, err := readRequestBody(rc); err == nil && json.Unmarshal(body, &bodyMap) == nil {
 				if val, ok := bodyMap[*cfg.IdentityFieldName]; ok {
 					if strVal, ok := val.(string); ok {
 						identifier = strVal
 					}
 				}
 			}
-			// Restore the body for further processing
-			if body, err := GetRequestBody(c); err == nil {
-				c.Request.Body = io.NopCloser(bytes.NewBufferString(body))
-			}
 		// Console strategies historically used "jwt" / "bearer"; agents use "bearer_token".
 		case "bearer_token", "bearer", "jwt":
-			if token, err := ExtractBearerToken(c); err == nil {
+			if token, err := extractBearerToken(req); err == nil {
 				if claims, err := DecodeJWTUnverified(token); err == nil {
 					if val, ok := claims[*cfg.IdentityFieldName]; ok {
 						if strVal, ok := val.(string); ok {
@@ -941,7 +1251,7 @@ func (u *UsageFlowAPI) GetUserPrefix(c *gin.Context, method, url string) (string
 			// Handle JWT cookie format: '[technique=jwt]cookieName[pick=claim]'
 			jwtCookieInfo := ParseJwtCookieField(*cfg.IdentityFieldName)
 			if jwtCookieInfo != nil {
-				cookieValue := GetCookieValue(c, jwtCookieInfo.CookieName)
+				cookieValue := getCookieValue(req, jwtCookieInfo.CookieName)
 				if cookieValue != "" {
 					claims, err := DecodeJWTUnverified(cookieValue)
 					if err == nil {
@@ -962,10 +1272,10 @@ func (u *UsageFlowAPI) GetUserPrefix(c *gin.Context, method, url string) (string
 			if strings.HasPrefix(fieldName, "cookie.") {
 				// Remove "cookie." prefix
 				cookieName := (*cfg.IdentityFieldName)[7:]
-				cookieValue = GetCookieValue(c, cookieName)
+				cookieValue = getCookieValue(req, cookieName)
 			} else {
 				// Use the field name directly as cookie name
-				cookieValue = GetCookieValue(c, *cfg.IdentityFieldName)
+				cookieValue = getCookieValue(req, *cfg.IdentityFieldName)
 			}
 
 			if cookieValue != "" {
@@ -975,19 +1285,20 @@ func (u *UsageFlowAPI) GetUserPrefix(c *gin.Context, method, url string) (string
 
 		// If we found an identifier, break out of the loop
 		if identifier != "" {
+			policy = &policies[i]
 			break
 		}
 	}
 
-	if !matched {
-		return "", false
+	if policy == nil {
+		return nil, "", false
 	}
 
 	// Keep rateLimited even when identity is missing so hasRateLimit policies
 	// still wait on allocation and can return 429 instead of fire-and-forget.
 	if identifier != "" {
-		return TransformToLedgerId(identifier), rateLimited
+		return policy, TransformToLedgerId(identifier), rateLimited
 	}
 
-	return "", rateLimited
+	return policy, "", rateLimited
 }
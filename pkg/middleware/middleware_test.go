@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,8 +20,8 @@ import (
 func TestNew(t *testing.T) {
 	api := New("test-api-key")
 	assert.NotNil(t, api)
-	// APIKey is not set in New(), only passed to socketManager
-	assert.NotNil(t, api.socketManager)
+	// APIKey is not set in New(), only passed to the transport
+	assert.NotNil(t, api.transport)
 	assert.NotNil(t, api.policyMap)
 }
 
@@ -27,7 +29,7 @@ func TestUsageFlowAPI_GuessLedgerId(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	tests := []struct {
 		name     string
@@ -65,7 +67,7 @@ func TestUsageFlowAPI_GetUserPrefix(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	tests := []struct {
 		name        string
@@ -628,7 +630,7 @@ func TestUsageFlowAPI_GetUserPrefix(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			api := New("test-api-key")
-			defer api.socketManager.Close()
+			defer api.transport.Close()
 
 			// Set up config for this test
 			api.mu.Lock()
@@ -652,7 +654,7 @@ func TestUsageFlowAPI_collectRequestMetadata(t *testing.T) {
 
 	api := New("test-api-key")
 	api.ApplicationId = "app-123"
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -660,7 +662,7 @@ func TestUsageFlowAPI_collectRequestMetadata(t *testing.T) {
 	c.Request.Header.Set("User-Agent", "test-agent")
 	c.Request.Header.Set("Authorization", "Bearer token123")
 
-	metadata := api.collectRequestMetadata(c)
+	metadata := api.collectRequestMetadata(ginRequest{c: c})
 
 	assert.Equal(t, "app-123", metadata["applicationId"])
 	assert.Equal(t, "POST", metadata["method"])
@@ -822,6 +824,32 @@ func TestApplyRouteConfig(t *testing.T) {
 	assert.False(t, api.reportAllFunctionAllocations)
 }
 
+func TestApplyRouteConfig_WildcardRoutes(t *testing.T) {
+	api := &UsageFlowAPI{}
+	err := api.applyRouteConfig(config.ApplicationConfigResponse{
+		MonitorPaths: []interface{}{
+			map[string]interface{}{"method": "*", "url": "/v2/**"},
+			map[string]interface{}{"method": "GET", "url": "/users/:id"},
+		},
+		WhitelistEndpoints: []interface{}{
+			map[string]interface{}{"method": "*", "url": "/internal/*"},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, api.monitoringRules.match(nil, "POST", "/v2"))
+	assert.True(t, api.monitoringRules.match(nil, "POST", "/v2/orders/:id"))
+	assert.True(t, api.monitoringRules.match(nil, "GET", "/users/{id}"))
+	assert.False(t, api.monitoringRules.match(nil, "DELETE", "/users/{id}"))
+	assert.False(t, api.monitoringRules.match(nil, "GET", "/v1/orders"))
+	assert.True(t, api.whitelistRules.match(nil, "GET", "/internal/metrics"))
+	assert.False(t, api.whitelistRules.match(nil, "GET", "/internal"))
+
+	api.Whitelist(config.Route{Method: "GET", URL: "/status/*"})
+	assert.True(t, api.whitelistRules.match(nil, "GET", "/status/db"))
+	assert.True(t, api.whitelistRules.match(nil, "GET", "/internal/metrics"), "local routes add to the compiled rules")
+}
+
 func TestApplyRouteConfigDoesNotPartiallyUpdateInvalidConfig(t *testing.T) {
 	api := &UsageFlowAPI{
 		WhitelistEndpoints:    []config.Route{{Method: "GET", URL: "/old-health"}},
@@ -848,7 +876,7 @@ func TestForceMonitorAll_IgnoresRemoteMonitoringPaths(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 	api.ForceMonitorAll()
 	api.monitoringPathsMap = map[string]map[string]bool{
 		"POST": {"/api/chat": true},
@@ -872,7 +900,7 @@ func TestUsageFlowAPI_ExecuteRequestWithMetadata(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -898,7 +926,7 @@ func TestRequestInterceptor_RateLimitedRouteFailsOpenWhenSocketUnavailable(t *te
 	gin.SetMode(gin.TestMode)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 	api.ForceMonitorAll()
 	api.ApiConfig = []config.ApiConfigStrategy{
 		{
@@ -963,7 +991,7 @@ func TestRequestInterceptor_RateLimitedRouteSettlesBeforeHandler(t *testing.T) {
 				},
 				BlockedEndpoints: map[string]bool{},
 				policyMap:        make(PolicyMap),
-				socketManager:    manager,
+				transport:        manager,
 				connected:        true,
 				forceMonitorAll:  true,
 				functionPolicies: make(map[string]config.ApiConfigStrategy),
@@ -1003,7 +1031,7 @@ func TestRequestInterceptor_NonRateLimitedRouteRemainsAsync(t *testing.T) {
 		ApiConfig:        []config.ApiConfigStrategy{},
 		BlockedEndpoints: map[string]bool{},
 		policyMap:        make(PolicyMap),
-		socketManager:    manager,
+		transport:        manager,
 		connected:        true,
 		forceMonitorAll:  true,
 		functionPolicies: make(map[string]config.ApiConfigStrategy),
@@ -1035,7 +1063,7 @@ func TestUsageFlowAPI_ExecuteFulfillRequestWithMetadata(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -1054,19 +1082,35 @@ func TestUsageFlowAPI_ExecuteFulfillRequestWithMetadata(t *testing.T) {
 }
 
 type fakeSocketManager struct {
+	// mu guards connected and closed, which Shutdown changes from a
+	// background Close.
+	mu            sync.Mutex
 	connected     bool
+	closed        bool
+	sendErr       error
 	responses     []*socket.UsageFlowSocketResponse
 	asyncMessages []*socket.UsageFlowSocketMessage
+	asyncContexts []context.Context
 	sentMessages  []*socket.UsageFlowSocketMessage
+	// blockAsync makes SendAsyncContext wait until its context is done.
+	blockAsync bool
 }
 
 func (f *fakeSocketManager) Send(message *socket.UsageFlowSocketMessage) error {
+	if f.sendErr != nil {
+		return f.sendErr
+	}
 	f.sentMessages = append(f.sentMessages, message)
 	return nil
 }
 
-func (f *fakeSocketManager) SendAsync(message *socket.UsageFlowSocketMessage) (*socket.UsageFlowSocketResponse, error) {
+func (f *fakeSocketManager) SendAsyncContext(ctx context.Context, message *socket.UsageFlowSocketMessage) (*socket.UsageFlowSocketResponse, error) {
 	f.asyncMessages = append(f.asyncMessages, message)
+	f.asyncContexts = append(f.asyncContexts, ctx)
+	if f.blockAsync {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 	if len(f.responses) == 0 {
 		return nil, errors.New("no fake response configured")
 	}
@@ -1076,10 +1120,23 @@ func (f *fakeSocketManager) SendAsync(message *socket.UsageFlowSocketMessage) (*
 }
 
 func (f *fakeSocketManager) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.connected
 }
 
-func (f *fakeSocketManager) Close() {}
+func (f *fakeSocketManager) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.connected = false
+}
+
+func (f *fakeSocketManager) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
 
 // Helper function
 func stringPtr(s string) *string {
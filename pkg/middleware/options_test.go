@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestNewOptions_Defaults(t *testing.T) {
+	o := newOptions(nil)
+	assert.Equal(t, defaultConfigRefreshInterval, o.configRefreshInterval)
+	assert.NotNil(t, o.logger)
+	assert.Nil(t, o.socket.Logger, "the socket package falls back to slog.Default for fatal errors")
+	assert.Empty(t, o.socket.URL, "socket defaults are applied by the socket package")
+}
+
+func TestNewOptions_Overrides(t *testing.T) {
+	dialer := &websocket.Dialer{}
+	o := newOptions([]Option{
+		WithWebSocketURL("ws://127.0.0.1:9000/ws"),
+		WithPoolSize(2),
+		WithRequestTimeout(250 * time.Millisecond),
+		WithConfigRefreshInterval(5 * time.Second),
+		WithReconnect(time.Second, 30*time.Second),
+		WithDialer(dialer),
+		WithBatching(20, 10*time.Millisecond),
+		WithOutboundQueue(500, socket.DropOldest, 0),
+		WithCompression(),
+		WithDecisionHook(func(Decision) {}),
+	})
+	assert.Equal(t, "ws://127.0.0.1:9000/ws", o.socket.URL)
+	assert.Equal(t, 2, o.socket.PoolSize)
+	assert.Equal(t, 250*time.Millisecond, o.socket.RequestTimeout)
+	assert.Equal(t, 5*time.Second, o.configRefreshInterval)
+	assert.Equal(t, time.Second, o.socket.ReconnectDelay)
+	assert.Equal(t, 30*time.Second, o.socket.MaxReconnectDelay)
+	assert.Same(t, dialer, o.socket.Dialer)
+	assert.Equal(t, 20, o.socket.BatchSize)
+	assert.Equal(t, 10*time.Millisecond, o.socket.BatchInterval)
+	assert.Equal(t, 500, o.socket.QueueSize)
+	assert.Equal(t, socket.DropOldest, o.socket.OverflowPolicy)
+	assert.True(t, o.socket.EnableCompression)
+	assert.NotNil(t, o.decisionHook)
+}
+
+func TestNewWithOptions_LocalServerAndRefreshInterval(t *testing.T) {
+	t.Setenv("USAGEFLOW_DISABLE_WS", "0")
+
+	var policyFetches atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg socket.UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type == "get_application_policies" {
+				policyFetches.Add(1)
+			}
+			_ = conn.WriteJSON(socket.UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID, Payload: map[string]interface{}{}})
+		}
+	}))
+	defer server.Close()
+
+	api := NewWithOptions("test-api-key",
+		WithWebSocketURL("ws"+server.URL[4:]),
+		WithPoolSize(1),
+		WithConfigRefreshInterval(20*time.Millisecond),
+	)
+	defer api.transport.Close()
+
+	assert.True(t, api.IsConnected())
+	assert.Eventually(t, func() bool {
+		return policyFetches.Load() >= 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestNewWithOptions_Transport(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := NewWithOptions("test-api-key", WithTransport(manager))
+	_, err := api.Shutdown(context.Background())
+	assert.NoError(t, err)
+
+	assert.Same(t, manager, api.transport)
+	assert.True(t, manager.isClosed())
+	if assert.NotEmpty(t, manager.asyncMessages) {
+		assert.Equal(t, "get_application_policies", manager.asyncMessages[0].Type)
+	}
+}
+
+func TestNewWithOptions_HTTPFallback(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	o := newOptions([]Option{WithHTTPFallback("https://ingest.example.com/agent", time.Minute), WithLogger(logger)})
+	if assert.NotNil(t, o.httpFallback) {
+		assert.Equal(t, "https://ingest.example.com/agent", o.httpFallback.URL)
+		assert.Same(t, logger, o.httpFallback.Logger)
+	}
+	assert.Equal(t, time.Minute, o.fallbackAfter)
+
+	api := NewWithOptions("test-api-key", WithHTTPFallback("https://ingest.example.com/agent", time.Minute))
+	defer api.Shutdown(context.Background())
+	assert.IsType(t, &socket.FallbackTransport{}, api.transport)
+
+	withoutURL := NewWithOptions("test-api-key", WithHTTPFallback("", time.Minute))
+	defer withoutURL.Shutdown(context.Background())
+	assert.IsType(t, &socket.UsageFlowSocketManager{}, withoutURL.transport, "fallback needs an explicit URL")
+}
+
+func TestWithStateChangeHandler(t *testing.T) {
+	var got []socket.ConnectionEvent
+	o := newOptions([]Option{WithStateChangeHandler(func(e socket.ConnectionEvent) { got = append(got, e) })})
+	if assert.NotNil(t, o.socket.OnStateChange) {
+		o.socket.OnStateChange(socket.ConnectionEvent{Index: 1, New: socket.StateConnected})
+		assert.Equal(t, []socket.ConnectionEvent{{Index: 1, New: socket.StateConnected}}, got)
+	}
+}
+
+func TestNewOptions_Egress(t *testing.T) {
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("agent", "s3cret"), Host: "proxy.internal:3128"}
+	tlsConfig := &tls.Config{ServerName: "api.usageflow.io"}
+	o := newOptions([]Option{
+		WithProxy(http.ProxyURL(proxyURL)),
+		WithTLSConfig(tlsConfig),
+		WithHandshakeHeader("X-Tenant", "acme"),
+		WithHTTPFallback("https://ingest.example.com/agent", time.Minute),
+	})
+
+	if assert.NotNil(t, o.socket.Proxy) {
+		got, err := o.socket.Proxy(httptest.NewRequest(http.MethodGet, "https://api.usageflow.io/ws", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, proxyURL, got)
+	}
+	assert.Same(t, tlsConfig, o.socket.TLSConfig)
+	assert.Equal(t, "acme", o.socket.Header.Get("X-Tenant"))
+
+	assert.Equal(t, "acme", o.httpFallback.Header.Get("X-Tenant"), "fallback requests carry the same headers")
+	if assert.NotNil(t, o.httpFallback.Client) {
+		transport := o.httpFallback.Client.Transport.(*http.Transport)
+		assert.Same(t, tlsConfig, transport.TLSClientConfig)
+		assert.NotNil(t, transport.Proxy)
+	}
+}
+
+func TestWithLogger_ReportsSwallowedErrors(t *testing.T) {
+	var buf bytes.Buffer
+	manager := &fakeSocketManager{
+		connected: true,
+		responses: []*socket.UsageFlowSocketResponse{
+			{Type: "error", Error: "quota exceeded"},
+			{Type: "error", Error: "quota exceeded"},
+		},
+	}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodGet, Url: "/search", HasRateLimit: true})
+	api.logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {})
+	handler := api.HTTPInterceptor()(mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/search", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/search", nil))
+
+	assert.Equal(t, 1, strings.Count(buf.String(), `msg="usageflow: allocation denied"`), "repeats are rate-limited")
+	assert.Contains(t, buf.String(), `route="GET /search"`)
+	assert.Contains(t, buf.String(), "alias=")
+
+	buf.Reset()
+	api.fetch(refreshBlockedEndpoints)
+	assert.Contains(t, buf.String(), `msg="usageflow: failed to refresh blocked_endpoints; keeping previous config"`)
+	assert.Contains(t, buf.String(), "no fake response configured")
+
+	buf.Reset()
+	func() {
+		defer api.recoverPanic("test")
+		panic("boom")
+	}()
+	assert.Contains(t, buf.String(), `level=ERROR msg="usageflow: recovered panic in test" panic=boom`)
+}
@@ -0,0 +1,88 @@
+// Package otel adapts OpenTelemetry tracing to the middleware's Tracer
+// interface. It lives in its own package so applications that do not trace
+// never import OpenTelemetry.
+//
+//	usageflow := middleware.NewWithOptions(apiKey,
+//		middleware.WithTracer(ufotel.NewTracer(otel.Tracer("usageflow"))),
+//	)
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer returns a middleware.Tracer that starts spans on tracer and
+// reads the active span from OpenTelemetry's context.
+func NewTracer(tracer trace.Tracer) middleware.Tracer {
+	return otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, middleware.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, otelSpan{span: span}
+}
+
+func (t otelTracer) SpanFromContext(ctx context.Context) middleware.Span {
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsValid() {
+		return nil
+	}
+	return otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value any) {
+	s.span.SetAttributes(attributeOf(key, value))
+}
+
+// RecordError records err as a span event and marks the span failed.
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) TraceID() string {
+	sc := s.span.SpanContext()
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
+
+// attributeOf converts the values the agent sets to typed attributes;
+// anything else is recorded as its string form.
+func attributeOf(key string, value any) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	case fmt.Stringer:
+		return attribute.String(key, v.String())
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,86 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+func remoteContext(t *testing.T) context.Context {
+	traceID, err := trace.TraceIDFromHex(testTraceID)
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, Remote: true})
+	return trace.ContextWithRemoteSpanContext(context.Background(), sc)
+}
+
+// recordingSpan captures what the adapter writes to an OpenTelemetry span.
+type recordingSpan struct {
+	trace.Span
+	attrs  []attribute.KeyValue
+	errs   []error
+	status codes.Code
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) { s.attrs = append(s.attrs, kv...) }
+func (s *recordingSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+func (s *recordingSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+func (s *recordingSpan) End(...trace.SpanEndOption)          { s.ended = true }
+
+func TestTracer_SpanFromContext(t *testing.T) {
+	tracer := NewTracer(noop.NewTracerProvider().Tracer("usageflow"))
+
+	assert.Nil(t, tracer.SpanFromContext(context.Background()), "no span without a valid span context")
+	span := tracer.SpanFromContext(remoteContext(t))
+	require.NotNil(t, span)
+	assert.Equal(t, testTraceID, span.TraceID())
+}
+
+func TestTracer_StartNestsUnderTheActiveSpan(t *testing.T) {
+	tracer := NewTracer(noop.NewTracerProvider().Tracer("usageflow"))
+
+	ctx, span := tracer.Start(remoteContext(t), "usageflow.allocate")
+	assert.Equal(t, testTraceID, span.TraceID())
+	assert.Equal(t, testTraceID, trace.SpanContextFromContext(ctx).TraceID().String(), "the returned context carries the span")
+	span.End()
+
+	_, orphan := tracer.Start(context.Background(), "usageflow.allocate")
+	assert.Empty(t, orphan.TraceID())
+}
+
+func TestSpan_AttributesAndErrors(t *testing.T) {
+	recorded := &recordingSpan{Span: noop.Span{}}
+	span := otelSpan{span: recorded}
+
+	span.SetAttribute("usageflow.alias", "POST /orders")
+	span.SetAttribute("usageflow.rate_limited", true)
+	span.SetAttribute("usageflow.amount", 2.5)
+	span.SetAttribute("usageflow.count", 3)
+	span.SetAttribute("usageflow.other", []string{"a"})
+	span.RecordError(errors.New("quota exceeded"))
+	span.End()
+
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("usageflow.alias", "POST /orders"),
+		attribute.Bool("usageflow.rate_limited", true),
+		attribute.Float64("usageflow.amount", 2.5),
+		attribute.Int("usageflow.count", 3),
+		attribute.String("usageflow.other", "[a]"),
+	}, recorded.attrs)
+	assert.Len(t, recorded.errs, 1)
+	assert.Equal(t, codes.Error, recorded.status)
+	assert.True(t, recorded.ended)
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"log/slog"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+// Server-pushed invalidation messages and the config each one refetches.
+const (
+	pushConfigUpdated           = "config_updated"
+	pushBlockedEndpointsUpdated = "blocked_endpoints_updated"
+)
+
+// refreshTarget is a bit set of config sections to refetch.
+type refreshTarget int32
+
+const (
+	refreshPolicies refreshTarget = 1 << iota
+	refreshApplicationConfig
+	refreshBlockedEndpoints
+
+	refreshAll = refreshPolicies | refreshApplicationConfig | refreshBlockedEndpoints
+)
+
+// pushSource is implemented by transports that deliver unsolicited server
+// messages, such as socket.UsageFlowSocketManager.
+type pushSource interface {
+	OnPush(fn func(*socket.UsageFlowSocketResponse)) func()
+}
+
+// subscribePushes wires server invalidation messages to targeted refetches
+// when the transport supports server push.
+func (u *UsageFlowAPI) subscribePushes() {
+	if src, ok := u.transport.(pushSource); ok {
+		src.OnPush(u.handlePush)
+	}
+}
+
+// handlePush runs on the transport's read goroutine, so it only records
+// what to refetch and wakes the config updater.
+func (u *UsageFlowAPI) handlePush(msg *socket.UsageFlowSocketResponse) {
+	switch msg.Type {
+	case pushConfigUpdated:
+		u.requestRefresh(refreshPolicies | refreshApplicationConfig)
+	case pushBlockedEndpointsUpdated:
+		u.requestRefresh(refreshBlockedEndpoints)
+	}
+}
+
+// requestRefresh schedules an immediate refetch of target on the updater
+// goroutine. Requests arriving before it runs are coalesced.
+func (u *UsageFlowAPI) requestRefresh(target refreshTarget) {
+	for {
+		old := u.pendingRefresh.Load()
+		if u.pendingRefresh.CompareAndSwap(old, old|int32(target)) {
+			break
+		}
+	}
+	select {
+	case u.refreshCh() <- struct{}{}:
+	default:
+	}
+}
+
+// refreshCh returns the updater's wake-up channel, creating it lazily like
+// stopCh.
+func (u *UsageFlowAPI) refreshCh() chan struct{} {
+	u.refreshInit.Do(func() {
+		u.refresh = make(chan struct{}, 1)
+	})
+	return u.refresh
+}
+
+// fetch refetches the config sections in target, in the updater's usual
+// order.
+func (u *UsageFlowAPI) fetch(target refreshTarget) {
+	if target&refreshPolicies != 0 {
+		_, err := u.FetchApiConfig()
+		u.configRefreshed(sectionPolicies, err)
+	}
+	if target&refreshBlockedEndpoints != 0 {
+		u.configRefreshed(sectionBlockedEndpoints, u.FetchBlockedEndpoints())
+	}
+	if target&refreshApplicationConfig != 0 {
+		_, err := u.FetchApplicationConfig()
+		u.configRefreshed(sectionApplicationConfig, err)
+	}
+}
+
+// configRefreshed records the result of fetching section. The previous
+// config stays in effect when the fetch fails.
+func (u *UsageFlowAPI) configRefreshed(section string, err error) {
+	u.metrics.configRefresh(section, err)
+	if err != nil {
+		u.logEvent(slog.LevelWarn, "usageflow: failed to refresh "+section+"; keeping previous config", "error", err)
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestHandlePush_CoalescesTargets(t *testing.T) {
+	api := newTestAPI(&fakeSocketManager{connected: true})
+
+	api.handlePush(&socket.UsageFlowSocketResponse{Type: pushBlockedEndpointsUpdated})
+	api.handlePush(&socket.UsageFlowSocketResponse{Type: "unknown"})
+	assert.Equal(t, int32(refreshBlockedEndpoints), api.pendingRefresh.Load())
+
+	api.handlePush(&socket.UsageFlowSocketResponse{Type: pushConfigUpdated})
+	assert.Equal(t, int32(refreshAll), api.pendingRefresh.Load())
+	assert.Len(t, api.refreshCh(), 1, "wake-ups are coalesced")
+}
+
+func TestNewWithOptions_PushedInvalidationRefetches(t *testing.T) {
+	t.Setenv("USAGEFLOW_DISABLE_WS", "0")
+
+	var policyFetches, blockedFetches atomic.Int32
+	var blocked atomic.Bool
+	var mu sync.Mutex
+	var serverConn *websocket.Conn
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		serverConn = conn
+		mu.Unlock()
+		for {
+			var msg socket.UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			payload := map[string]interface{}{}
+			switch msg.Type {
+			case "get_application_policies":
+				policyFetches.Add(1)
+			case "get_blocked_endpoints":
+				blockedFetches.Add(1)
+				if blocked.Load() {
+					payload["endpoints"] = []map[string]interface{}{{"method": "DELETE", "url": "/admin"}}
+				}
+			}
+			mu.Lock()
+			_ = conn.WriteJSON(socket.UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID, Payload: payload})
+			mu.Unlock()
+		}
+	}))
+	defer server.Close()
+
+	api := NewWithOptions("test-api-key",
+		WithWebSocketURL("ws"+server.URL[4:]),
+		WithPoolSize(1),
+		WithConfigRefreshInterval(time.Hour),
+	)
+	defer api.Shutdown(context.Background())
+
+	assert.Eventually(t, func() bool { return blockedFetches.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	blocked.Store(true)
+	mu.Lock()
+	_ = serverConn.WriteJSON(socket.UsageFlowSocketResponse{Type: pushBlockedEndpointsUpdated})
+	mu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		api.mu.RLock()
+		defer api.mu.RUnlock()
+		return api.BlockedEndpoints["DELETE /admin"]
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), blockedFetches.Load())
+	assert.Equal(t, int32(1), policyFetches.Load(), "only the invalidated section is refetched")
+}
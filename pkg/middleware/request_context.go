@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestContext is the framework-neutral view of an intercepted request.
+// The metering flow in interceptRequest only talks to this interface so Gin,
+// net/http and other router adapters share allocation, fulfill, identity
+// extraction and response capture behavior.
+type requestContext interface {
+	// Request returns the current request; SetRequest replaces it (e.g. to
+	// attach a tracking context or restore a consumed body).
+	Request() *http.Request
+	SetRequest(*http.Request)
+	// RoutePattern returns the metered route (e.g. "/users/:id"), falling
+	// back to the raw path when the router has no pattern for the request.
+	RoutePattern() string
+	// RouteMatched reports whether RoutePattern is a router pattern rather
+	// than the raw-path fallback.
+	RouteMatched() bool
+	Param(name string) string
+	Params() map[string]string
+	ClientIP() string
+	// Set and Get store per-request values shared between allocation and fulfill.
+	Set(key string, value interface{})
+	Get(key string) (interface{}, bool)
+	// Next runs the downstream handler chain.
+	Next()
+	AbortWithJSON(code int, body map[string]interface{})
+	// CaptureResponse starts teeing the response body; call before Next.
+	CaptureResponse() *responseCapture
+	// Status returns the response status written by the handler.
+	Status() int
+}
+
+// ginRequest adapts *gin.Context to requestContext.
+type ginRequest struct {
+	c *gin.Context
+}
+
+func (g ginRequest) Request() *http.Request {
+	return g.c.Request
+}
+
+func (g ginRequest) SetRequest(r *http.Request) {
+	g.c.Request = r
+}
+
+func (g ginRequest) RoutePattern() string {
+	return GetPatternedURL(g.c)
+}
+
+func (g ginRequest) RouteMatched() bool {
+	return g.c.FullPath() != ""
+}
+
+func (g ginRequest) Param(name string) string {
+	return g.c.Param(name)
+}
+
+func (g ginRequest) Params() map[string]string {
+	if len(g.c.Params) == 0 {
+		return nil
+	}
+	params := make(map[string]string, len(g.c.Params))
+	for _, param := range g.c.Params {
+		params[param.Key] = param.Value
+	}
+	return params
+}
+
+func (g ginRequest) ClientIP() string {
+	return g.c.ClientIP()
+}
+
+func (g ginRequest) Set(key string, value interface{}) {
+	g.c.Set(key, value)
+}
+
+func (g ginRequest) Get(key string) (interface{}, bool) {
+	return g.c.Get(key)
+}
+
+func (g ginRequest) Next() {
+	g.c.Next()
+}
+
+func (g ginRequest) AbortWithJSON(code int, body map[string]interface{}) {
+	g.c.AbortWithStatusJSON(code, body)
+}
+
+func (g ginRequest) CaptureResponse() *responseCapture {
+	return attachBodyCapture(g.c).capture
+}
+
+func (g ginRequest) Status() int {
+	return g.c.Writer.Status()
+}
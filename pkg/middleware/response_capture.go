@@ -11,33 +11,51 @@ import (
 
 const maxCapturedResponseBytes = 512 * 1024
 
-// bodyCaptureWriter tees the response body so we can derive responseSchema (JS parity).
-type bodyCaptureWriter struct {
-	gin.ResponseWriter
+// responseCapture buffers up to maxCapturedResponseBytes of a response body
+// so we can derive responseSchema (JS parity). Framework writers feed it.
+type responseCapture struct {
 	buf        *bytes.Buffer
 	truncated  bool
 	statusCode int
 }
 
+func newResponseCapture() *responseCapture {
+	return &responseCapture{
+		buf:        &bytes.Buffer{},
+		statusCode: http.StatusOK,
+	}
+}
+
+func (r *responseCapture) write(b []byte) {
+	if r.truncated {
+		return
+	}
+	remaining := maxCapturedResponseBytes - r.buf.Len()
+	if remaining <= 0 {
+		r.truncated = true
+		return
+	}
+	if len(b) > remaining {
+		r.buf.Write(b[:remaining])
+		r.truncated = true
+		return
+	}
+	r.buf.Write(b)
+}
+
+// bodyCaptureWriter tees the Gin response body into a responseCapture.
+type bodyCaptureWriter struct {
+	gin.ResponseWriter
+	capture *responseCapture
+}
+
 func (w *bodyCaptureWriter) WriteHeader(code int) {
-	w.statusCode = code
+	w.capture.statusCode = code
 	w.ResponseWriter.WriteHeader(code)
 }
 
 func (w *bodyCaptureWriter) Write(b []byte) (int, error) {
-	if !w.truncated {
-		remaining := maxCapturedResponseBytes - w.buf.Len()
-		if remaining > 0 {
-			if len(b) > remaining {
-				w.buf.Write(b[:remaining])
-				w.truncated = true
-			} else {
-				w.buf.Write(b)
-			}
-		} else {
-			w.truncated = true
-		}
-	}
+	w.capture.write(b)
 	return w.ResponseWriter.Write(b)
 }
 
@@ -48,21 +66,20 @@ func (w *bodyCaptureWriter) WriteString(s string) (int, error) {
 func attachBodyCapture(c *gin.Context) *bodyCaptureWriter {
 	blw := &bodyCaptureWriter{
 		ResponseWriter: c.Writer,
-		buf:            &bytes.Buffer{},
-		statusCode:     http.StatusOK,
+		capture:        newResponseCapture(),
 	}
 	c.Writer = blw
 	return blw
 }
 
-func parseCapturedResponseBody(blw *bodyCaptureWriter) interface{} {
-	if blw == nil || blw.buf.Len() == 0 {
+func parseCapturedResponseBody(capture *responseCapture) interface{} {
+	if capture == nil || capture.buf.Len() == 0 {
 		return nil
 	}
-	if blw.truncated {
-		return map[string]interface{}{"_truncated": true, "length": blw.buf.Len()}
+	if capture.truncated {
+		return map[string]interface{}{"_truncated": true, "length": capture.buf.Len()}
 	}
-	raw := blw.buf.Bytes()
+	raw := capture.buf.Bytes()
 	var asJSON interface{}
 	if err := json.Unmarshal(raw, &asJSON); err == nil {
 		return asJSON
@@ -74,9 +91,9 @@ func parseCapturedResponseBody(blw *bodyCaptureWriter) interface{} {
 	return s
 }
 
-func enrichFulfillMetadataWithResponse(metadata map[string]interface{}, blw *bodyCaptureWriter, responseTrackingField string) float64 {
+func enrichFulfillMetadataWithResponse(metadata map[string]interface{}, capture *responseCapture, responseTrackingField string) float64 {
 	amount := 1.0
-	body := parseCapturedResponseBody(blw)
+	body := parseCapturedResponseBody(capture)
 	if body == nil {
 		return amount
 	}
@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+)
+
+// routePattern is a compiled route URL containing wildcards. Segments are
+// matched one to one, except "**", which matches any number of segments:
+//
+//   - "*" matches exactly one segment;
+//   - "**" matches zero or more;
+//   - a trailing "/*" matches one or more, so "/api/*" covers every route
+//     under /api;
+//   - other segments containing "*" are globs within the segment ("v*");
+//   - parameters (":id", "{id}") only match a parameter of the route and
+//     catch-alls ("*filepath", "{path...}") only a catch-all, whatever the
+//     name or syntax, so "/users/:id" never covers the static "/users/me".
+type routePattern []string
+
+// Compiled forms of parameter and catch-all segments. They start with a
+// NUL byte so they cannot collide with a literal segment.
+const (
+	paramSegment    = "\x00param"
+	catchAllSegment = "\x00catchall"
+)
+
+// routeRule is a compiled route that needs more than an exact map lookup:
+// its URL has wildcards, or it is scoped to a host or to request headers.
+type routeRule struct {
+	url string
+	// pattern is set when url has wildcards.
+	pattern routePattern
+	// host is lowercase; a "*." prefix matches any subdomain.
+	host string
+	// headers maps canonical header names to the required value, or "*".
+	headers map[string]string
+}
+
+// routeRules holds the compiled rules of a route set by method ("*" for any
+// method). Other routes are matched through the exact route map.
+type routeRules map[string][]routeRule
+
+// isScopedRoute reports whether route only applies to some hosts or to
+// requests with certain headers. Scoped routes are kept out of the exact
+// route maps.
+func isScopedRoute(route config.Route) bool {
+	return route.Host != "" || len(route.Headers) > 0
+}
+
+func compileRouteRule(route config.Route) routeRule {
+	rule := routeRule{url: route.URL, host: strings.ToLower(route.Host)}
+	if isRoutePattern(route.URL) {
+		rule.pattern = compileRoutePattern(route.URL)
+	}
+	if len(route.Headers) > 0 {
+		rule.headers = make(map[string]string, len(route.Headers))
+		for name, value := range route.Headers {
+			rule.headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return rule
+}
+
+func (r routeRule) scoped() bool {
+	return r.host != "" || len(r.headers) > 0
+}
+
+// match reports whether the rule covers a request to the route url, split
+// into segments. req may be nil when only the route is known, in which case
+// scoped rules never match.
+func (r routeRule) match(req *http.Request, url string, segments []string) bool {
+	switch {
+	case r.pattern != nil:
+		if !matchSegments(r.pattern, segments) {
+			return false
+		}
+	case r.url != "*" && r.url != url:
+		return false
+	}
+	if !r.scoped() {
+		return true
+	}
+	if req == nil || (r.host != "" && !matchHost(r.host, req.Host)) {
+		return false
+	}
+	for name, want := range r.headers {
+		values := req.Header.Values(name)
+		if len(values) == 0 || (want != "*" && !slices.Contains(values, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost compares a rule host with a request Host header, ignoring the
+// port and case.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// isRoutePattern reports whether url needs wildcard matching. A bare "*"
+// already matches every URL through the route map.
+func isRoutePattern(url string) bool {
+	if url == "*" {
+		return false
+	}
+	for _, segment := range strings.Split(url, "/") {
+		if strings.Contains(segment, "*") || isParamSegment(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeSegments splits a route URL into its path segments.
+func routeSegments(url string) []string {
+	return strings.Split(strings.TrimPrefix(url, "/"), "/")
+}
+
+func compileRoutePattern(url string) routePattern {
+	segments := routeSegments(url)
+	pattern := make(routePattern, 0, len(segments)+1)
+	for _, segment := range segments {
+		switch {
+		case isCatchAllSegment(segment):
+			pattern = append(pattern, catchAllSegment)
+		case isParamSegment(segment):
+			pattern = append(pattern, paramSegment)
+		default:
+			pattern = append(pattern, segment)
+		}
+	}
+	if segments[len(segments)-1] == "*" {
+		pattern = append(pattern, "**")
+	}
+	return pattern
+}
+
+// compileRouteRules compiles the wildcard and scoped routes of routeSets.
+func compileRouteRules(routeSets ...[]config.Route) routeRules {
+	var rules routeRules
+	for _, routes := range routeSets {
+		rules = rules.add(routes)
+	}
+	return rules
+}
+
+// add compiles the wildcard and scoped routes in routes into r, allocating
+// r if needed.
+func (r routeRules) add(routes []config.Route) routeRules {
+	for _, route := range routes {
+		if route.Method == "" || route.URL == "" || (!isScopedRoute(route) && !isRoutePattern(route.URL)) {
+			continue
+		}
+		if r == nil {
+			r = make(routeRules)
+		}
+		r[route.Method] = append(r[route.Method], compileRouteRule(route))
+	}
+	return r
+}
+
+// match reports whether a rule for method (or any method) covers a request
+// to the route url.
+func (r routeRules) match(req *http.Request, method, url string) bool {
+	if len(r) == 0 {
+		return false
+	}
+	segments := routeSegments(url)
+	for _, m := range []string{method, "*"} {
+		for _, rule := range r[m] {
+			if rule.match(req, url, segments) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isMonitored reports whether the monitoring routes cover a request. As in
+// isRouteMonitored, an empty monitoringPaths list monitors every route.
+func isMonitored(req *http.Request, method, url string, routesMap map[string]map[string]bool, rules routeRules) bool {
+	if rules.match(req, method, url) {
+		return true
+	}
+	if len(routesMap) == 0 {
+		return len(rules) == 0
+	}
+	return isRouteMonitored(method, url, routesMap)
+}
+
+func matchSegments(pattern routePattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		switch seg := pattern[0]; {
+		case seg == "*":
+		case seg == paramSegment:
+			if !isParamSegment(segments[0]) {
+				return false
+			}
+		case seg == catchAllSegment:
+			if !isCatchAllSegment(segments[0]) {
+				return false
+			}
+		case strings.Contains(seg, "*"):
+			if ok, _ := path.Match(seg, segments[0]); !ok {
+				return false
+			}
+		case seg != segments[0]:
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// isParamSegment reports whether segment is a Gin (":id") or net/http and
+// chi ("{id}") path parameter.
+func isParamSegment(segment string) bool {
+	return (len(segment) > 1 && segment[0] == ':') ||
+		(len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}')
+}
+
+// isCatchAllSegment reports whether segment is a Gin ("*filepath") or
+// net/http ("{path...}") catch-all parameter.
+func isCatchAllSegment(segment string) bool {
+	if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "...}") {
+		return true
+	}
+	if len(segment) < 2 || segment[0] != '*' {
+		return false
+	}
+	for _, c := range segment[1:] {
+		if c != '_' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+)
+
+func TestRoutePattern_Match(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		want    bool
+	}{
+		{"/api/*", "/api/users", true},
+		{"/api/*", "/api/users/:id/orders", true},
+		{"/api/*", "/api", false},
+		{"/api/*", "/apiv2/users", false},
+		{"/api/*/orders", "/api/users/orders", true},
+		{"/api/*/orders", "/api/users/1/orders", false},
+		{"/api/**", "/api", true},
+		{"/api/**/export", "/api/reports/2024/export", true},
+		{"/api/**/export", "/api/export", true},
+		{"/**/health", "/health", true},
+		{"/users/:id", "/users/{id}", true},
+		{"/users/:id", "/users/:userId", true},
+		{"/users/:id", "/users/me", false},
+		{"/users/{id}", "/users/:id/orders", false},
+		{"/users/*", "/users/me", true},
+		{"/static/*filepath", "/static/{path...}", true},
+		{"/static/*filepath", "/static/css/site.css", false},
+		{"/files/{path...}", "/files", false},
+		{"/files/**", "/files/*filepath", true},
+		{"/v*/users", "/v2/users", true},
+		{"/v*/users", "/api/users", false},
+	}
+	for _, tt := range tests {
+		got := compileRouteRules([]config.Route{{Method: "*", URL: tt.pattern}}).match(nil, http.MethodGet, tt.url)
+		assert.Equal(t, tt.want, got, "%s against %s", tt.pattern, tt.url)
+	}
+}
+
+func TestIsRoutePattern(t *testing.T) {
+	assert.False(t, isRoutePattern("*"))
+	assert.False(t, isRoutePattern("/api/users"))
+	assert.True(t, isRoutePattern("/api/*"))
+	assert.True(t, isRoutePattern("/users/:id"))
+	assert.True(t, isRoutePattern("/users/{id}"))
+}
+
+func TestInterceptRequest_WhitelistsRouteGroups(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.Whitelist(config.Route{Method: "*", URL: "/internal/*"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /internal/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /orders", func(w http.ResponseWriter, r *http.Request) {})
+	handler := api.HTTPInterceptor()(mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/internal/jobs/7", nil))
+	assert.Empty(t, manager.sentMessages)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders", nil))
+	assert.NotEmpty(t, manager.sentMessages)
+}
+
+func TestRouteRule_HostAndHeaders(t *testing.T) {
+	rules := compileRouteRules([]config.Route{
+		{Method: "*", URL: "*", Headers: map[string]string{"x-internal": "1"}},
+		{Method: http.MethodGet, URL: "/search", Host: "api.example.com"},
+		{Method: http.MethodGet, URL: "/reports/*", Host: "*.tenants.example.com", Headers: map[string]string{"Authorization": "*"}},
+	})
+	request := func(target string, header ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		return req
+	}
+
+	assert.True(t, rules.match(request("/orders", "X-Internal", "0", "X-Internal", "1"), http.MethodGet, "/orders"))
+	assert.False(t, rules.match(request("/orders", "X-Internal", "0"), http.MethodGet, "/orders"))
+	assert.True(t, rules.match(request("http://API.example.com:8443/search"), http.MethodGet, "/search"))
+	assert.False(t, rules.match(request("http://www.example.com/search"), http.MethodGet, "/search"))
+	assert.True(t, rules.match(request("http://acme.tenants.example.com/reports/7", "Authorization", "Bearer t"), http.MethodGet, "/reports/:id"))
+	assert.False(t, rules.match(request("http://acme.tenants.example.com/reports/7"), http.MethodGet, "/reports/:id"))
+	assert.False(t, rules.match(request("http://tenants.example.com/reports/7", "Authorization", "Bearer t"), http.MethodGet, "/reports/:id"))
+	assert.False(t, rules.match(nil, http.MethodGet, "/search"), "scoped rules need a request")
+}
+
+func TestInterceptRequest_HostAndHeaderScopedRoutes(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.forceMonitorAll = false
+	require.NoError(t, api.applyRouteConfig(config.ApplicationConfigResponse{
+		MonitorPaths: []interface{}{
+			map[string]interface{}{"method": "GET", "url": "/search", "host": "api.example.com"},
+		},
+	}))
+	api.Whitelist(config.Route{Method: "*", URL: "*", Headers: map[string]string{"X-Internal": "1"}})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {})
+	handler := api.HTTPInterceptor()(mux)
+	serve := func(target string, internal bool) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if internal {
+			req.Header.Set("X-Internal", "1")
+		}
+		before := len(manager.sentMessages)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return len(manager.sentMessages) - before
+	}
+
+	assert.Zero(t, serve("http://www.example.com/search", false), "other hosts are not monitored")
+	assert.Zero(t, serve("http://api.example.com/search", true), "internal calls are whitelisted")
+	assert.NotZero(t, serve("http://api.example.com/search", false))
+
+	decisions := api.DebugState().RecentDecisions
+	require.Len(t, decisions, 3)
+	assert.Equal(t, OutcomeWhitelisted, decisions[1].Outcome)
+	assert.Equal(t, OutcomeNotMonitored, decisions[2].Outcome)
+}
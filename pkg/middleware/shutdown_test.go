@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestShutdown_Idle(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+	api.StartConfigUpdater()
+
+	dropped, err := api.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	assert.True(t, manager.isClosed())
+	assert.False(t, api.IsConnected())
+
+	// Shutdown is idempotent.
+	_, err = api.Shutdown(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/orders", nil))
+	}()
+	<-started
+
+	time.AfterFunc(30*time.Millisecond, func() { close(release) })
+	dropped, err := api.Shutdown(context.Background())
+	<-served
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	assert.Len(t, manager.sentMessages, 2, "allocation and fulfill are sent before the pool closes")
+	assert.True(t, manager.isClosed())
+}
+
+func TestShutdown_DeadlineLeavesRequestsPending(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/orders", nil))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	dropped, err := api.Shutdown(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, dropped, "in-flight requests are not events")
+	assert.Eventually(t, manager.isClosed, time.Second, time.Millisecond)
+
+	close(release)
+	<-served
+}
+
+// slowCloseTransport takes until release is closed to shut down, like a
+// transport draining a long outbound queue.
+type slowCloseTransport struct {
+	*fakeSocketManager
+	release chan struct{}
+}
+
+func (s *slowCloseTransport) Close() {
+	<-s.release
+	s.fakeSocketManager.Close()
+}
+
+func TestShutdown_DeadlineBoundsTransportClose(t *testing.T) {
+	transport := &slowCloseTransport{fakeSocketManager: &fakeSocketManager{connected: true}, release: make(chan struct{})}
+	defer close(transport.release)
+	api := newTestAPI(transport.fakeSocketManager)
+	api.transport = transport
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := api.Shutdown(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestShutdown_CountsRejectedSends(t *testing.T) {
+	manager := &fakeSocketManager{connected: true, sendErr: errors.New("WebSocket not connected")}
+	api := newTestAPI(manager)
+
+	w := httptest.NewRecorder()
+	api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	dropped, err := api.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+}
+
+// queuedTransport reports outbound queue losses like the socket manager.
+type queuedTransport struct {
+	*fakeSocketManager
+	stats socket.QueueStats
+}
+
+func (q *queuedTransport) QueueStats() socket.QueueStats { return q.stats }
+
+func TestShutdown_CountsQueueLosses(t *testing.T) {
+	transport := &queuedTransport{
+		fakeSocketManager: &fakeSocketManager{connected: true},
+		stats:             socket.QueueStats{Rejected: 4, Evicted: 2, Undelivered: 1},
+	}
+	api := newTestAPI(transport.fakeSocketManager)
+	api.transport = transport
+
+	assert.Equal(t, transport.stats, api.QueueStats())
+	dropped, err := api.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, dropped, "rejected sends are counted by the middleware when Send fails")
+}
+
+// reportingQueueTransport reports its queue losses through OnUndelivered as
+// well as in QueueStats, like the socket manager.
+type reportingQueueTransport struct {
+	batchingTransport
+	stats socket.QueueStats
+}
+
+func (q *reportingQueueTransport) QueueStats() socket.QueueStats { return q.stats }
+
+func TestShutdown_CountsReportedQueueLossesOnce(t *testing.T) {
+	transport := &reportingQueueTransport{
+		batchingTransport: batchingTransport{fakeSocketManager: fakeSocketManager{connected: true}},
+		stats:             socket.QueueStats{Evicted: 1, Undelivered: 1},
+	}
+	api := newTestAPI(&transport.fakeSocketManager)
+	api.transport = transport
+	api.subscribeUndelivered()
+
+	transport.onUndelivered([]*socket.UsageFlowSocketMessage{{Type: "use_allocation"}}, socket.ErrQueueFull)
+	transport.onUndelivered([]*socket.UsageFlowSocketMessage{{Type: "report_call_chain"}}, errors.New("write failed"))
+
+	dropped, err := api.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+}
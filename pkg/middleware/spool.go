@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"errors"
+	"time"
+
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+// spoolReplayInterval is how often the replayer checks for a reconnected
+// transport while events are spooled.
+const spoolReplayInterval = time.Second
+
+// spoolableEvents are the fire-and-forget messages worth keeping across an
+// outage. Rate-limited round trips are never spooled: they need an answer
+// while the request is in flight.
+var spoolableEvents = map[string]bool{
+	"request_for_allocation": true,
+	"use_allocation":         true,
+	"report_call_chain":      true,
+}
+
+// spoolEvent appends msg to the spool and reports whether it was kept.
+func (u *UsageFlowAPI) spoolEvent(msg *socket.UsageFlowSocketMessage) bool {
+	if u.spool == nil || !spoolableEvents[msg.Type] {
+		return false
+	}
+	if err := u.spool.Append(msg); err != nil {
+		// After Shutdown the event is counted as dropped instead.
+		if !errors.Is(err, socket.ErrSpoolClosed) {
+			u.log().Warn("usageflow: failed to spool event", "type", msg.Type, "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// undeliveredSource is implemented by transports that report events they
+// accepted but failed to write, such as socket.UsageFlowSocketManager with
+// batching.
+type undeliveredSource interface {
+	OnUndelivered(fn func([]*socket.UsageFlowSocketMessage, error)) func()
+}
+
+// directSender is implemented by transports that can write an event
+// synchronously, bypassing batching.
+type directSender interface {
+	SendDirect(msg *socket.UsageFlowSocketMessage) error
+}
+
+// subscribeUndelivered spools, or counts as dropped, the events the
+// transport loses after Send returned.
+func (u *UsageFlowAPI) subscribeUndelivered() {
+	if src, ok := u.transport.(undeliveredSource); ok {
+		src.OnUndelivered(func(msgs []*socket.UsageFlowSocketMessage, err error) {
+			for _, msg := range msgs {
+				u.spoolOrDrop(msg, err)
+			}
+		})
+	}
+}
+
+// startSpoolReplayer replays spooled events whenever the transport is
+// connected, until Shutdown.
+func (u *UsageFlowAPI) startSpoolReplayer() {
+	stop := u.stopCh()
+	u.background.Add(1)
+	go func() {
+		defer u.background.Done()
+		ticker := time.NewTicker(spoolReplayInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				u.replaySpool()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// replaySpool sends spooled events in order. Events are written directly
+// when the transport supports it, so a segment is only discarded once its
+// events have been written rather than queued for a later batch. Delivery is
+// at least once: a crash mid-segment resends the entries already sent from
+// it. Allocations and settlements carry the allocation ID assigned before
+// spooling, but call-chain reports have no idempotency key and may be
+// reported twice.
+func (u *UsageFlowAPI) replaySpool() {
+	if u.spool.Len() == 0 || !u.transport.IsConnected() {
+		return
+	}
+	send := u.transport.Send
+	if d, ok := u.transport.(directSender); ok {
+		send = d.SendDirect
+	}
+	sent, err := u.spool.Replay(send)
+	if sent > 0 {
+		u.log().Info("usageflow: replayed spooled events", "sent", sent)
+	}
+	if err != nil {
+		u.log().Warn("usageflow: spool replay interrupted", "remaining", u.spool.Len(), "error", err)
+	}
+}
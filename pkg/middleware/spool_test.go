@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func TestSpool_OutageEventsReplayAfterReconnect(t *testing.T) {
+	manager := &fakeSocketManager{connected: false}
+	api := newTestAPI(manager)
+	spool, err := socket.OpenSpool(socket.SpoolConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+	api.spool = spool
+
+	handler := api.HTTPInterceptor()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code, "outages still fail open")
+	assert.Equal(t, 2, spool.Len())
+	assert.Empty(t, manager.sentMessages)
+
+	manager.connected = true
+	api.replaySpool()
+
+	assert.Equal(t, 0, spool.Len())
+	if assert.Len(t, manager.sentMessages, 2) {
+		assert.Equal(t, "request_for_allocation", manager.sentMessages[0].Type)
+		assert.Equal(t, "use_allocation", manager.sentMessages[1].Type)
+
+		var alloc socket.RequestForAllocation
+		var use socket.UseAllocationRequest
+		require.NoError(t, json.Unmarshal(manager.sentMessages[0].Payload.(json.RawMessage), &alloc))
+		require.NoError(t, json.Unmarshal(manager.sentMessages[1].Payload.(json.RawMessage), &use))
+		require.NotNil(t, alloc.AllocationID)
+		assert.Equal(t, *alloc.AllocationID, use.AllocationID, "settlement replays with the spooled allocation ID")
+	}
+
+	dropped, err := api.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+}
+
+// batchingTransport stands in for a transport whose Send only queues: tests
+// report lost events through onUndelivered, and SendDirect records writes
+// that bypass the queue.
+type batchingTransport struct {
+	fakeSocketManager
+	direct        []*socket.UsageFlowSocketMessage
+	onUndelivered func([]*socket.UsageFlowSocketMessage, error)
+}
+
+func (f *batchingTransport) SendDirect(msg *socket.UsageFlowSocketMessage) error {
+	f.direct = append(f.direct, msg)
+	return nil
+}
+
+func (f *batchingTransport) OnUndelivered(fn func([]*socket.UsageFlowSocketMessage, error)) func() {
+	f.onUndelivered = fn
+	return func() {}
+}
+
+func TestSpool_UndeliveredEventsAreSpooledAndReplayedDirectly(t *testing.T) {
+	transport := &batchingTransport{fakeSocketManager: fakeSocketManager{connected: true}}
+	api := newTestAPI(&transport.fakeSocketManager)
+	api.transport = transport
+	spool, err := socket.OpenSpool(socket.SpoolConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+	api.spool = spool
+	api.subscribeUndelivered()
+	require.NotNil(t, transport.onUndelivered)
+
+	lost := []*socket.UsageFlowSocketMessage{
+		{Type: "use_allocation"},
+		{Type: "get_application_config"},
+	}
+	transport.onUndelivered(lost, errors.New("write failed"))
+	assert.Equal(t, 1, spool.Len(), "only metering events are spooled")
+	assert.Equal(t, int64(1), api.droppedEvents.Load())
+
+	api.replaySpool()
+	assert.Equal(t, 0, spool.Len())
+	assert.Empty(t, transport.sentMessages, "replay must not go through the batching Send")
+	if assert.Len(t, transport.direct, 1) {
+		assert.Equal(t, "use_allocation", transport.direct[0].Type)
+	}
+}
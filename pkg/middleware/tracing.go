@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+)
+
+// Span attribute keys set by the agent.
+const (
+	AttributeRequestID    = "usageflow.request_id"
+	AttributeAlias        = "usageflow.alias"
+	AttributeAmount       = "usageflow.amount"
+	AttributeRateLimited  = "usageflow.rate_limited"
+	AttributeAllocationID = "usageflow.allocation_id"
+)
+
+// Span names used for UsageFlow round trips.
+const (
+	SpanAllocate = "usageflow.allocate"
+	SpanSettle   = "usageflow.settle"
+)
+
+// Tracer connects the agent to a tracing library without this package
+// depending on it. See WithTracer; the otel subpackage adapts OpenTelemetry.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// SpanFromContext returns the span active in ctx, or nil if there is
+	// none. The agent annotates it but never ends it.
+	SpanFromContext(ctx context.Context) Span
+}
+
+// Span is the part of a tracing span the agent uses.
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	// TraceID returns the W3C trace ID as 32 lowercase hex digits, or ""
+	// if the span is not recording a valid trace.
+	TraceID() string
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, any) {}
+func (noopSpan) RecordError(error)        {}
+func (noopSpan) TraceID() string          { return "" }
+func (noopSpan) End()                     {}
+
+// startSpan starts name under the span in ctx and returns the context that
+// carries it, so work done on that context nests under the new span.
+// Without a tracer it returns ctx and a span that does nothing.
+func (u *UsageFlowAPI) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if u.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	spanCtx, span := u.tracer.Start(ctx, name)
+	if span == nil {
+		return ctx, noopSpan{}
+	}
+	if spanCtx == nil {
+		spanCtx = ctx
+	}
+	return spanCtx, span
+}
+
+// activeSpan returns the caller's span for the request, or a span that does
+// nothing.
+func (u *UsageFlowAPI) activeSpan(rc requestContext) Span {
+	if u.tracer != nil {
+		if span := u.tracer.SpanFromContext(rc.Request().Context()); span != nil {
+			return span
+		}
+	}
+	return noopSpan{}
+}
+
+// traceRequest links the request to its trace: it tags the active span with
+// the UsageFlow request ID and alias, and returns the W3C trace ID from the
+// active span or, failing that, from the incoming traceparent header.
+func (u *UsageFlowAPI) traceRequest(rc requestContext, usageflowRequestID, alias string) string {
+	span := u.activeSpan(rc)
+	span.SetAttribute(AttributeRequestID, usageflowRequestID)
+	span.SetAttribute(AttributeAlias, alias)
+	if traceID := span.TraceID(); traceID != "" {
+		return traceID
+	}
+	return parseTraceparent(rc.Request().Header.Get("traceparent"))
+}
+
+// parseTraceparent returns the trace ID of a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or "" if the header is invalid.
+// Versions after 00 may append fields, which are ignored.
+func parseTraceparent(header string) string {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return ""
+	}
+	if !isLowerHex(traceID, 32) || !isLowerHex(parentID, 16) || !isLowerHex(flags, 2) {
+		return ""
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return ""
+	}
+	return traceID
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
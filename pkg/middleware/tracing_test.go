@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+const testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+type fakeSpan struct {
+	name    string
+	traceID string
+	attrs   map[string]any
+	errs    []error
+	ended   bool
+}
+
+func (s *fakeSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+func (s *fakeSpan) RecordError(err error)              { s.errs = append(s.errs, err) }
+func (s *fakeSpan) TraceID() string                    { return s.traceID }
+func (s *fakeSpan) End()                               { s.ended = true }
+
+type activeSpanKey struct{}
+
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &fakeSpan{name: name, attrs: map[string]any{}}
+	if parent, ok := t.SpanFromContext(ctx).(*fakeSpan); ok {
+		span.traceID = parent.traceID
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, activeSpanKey{}, span), span
+}
+
+func (t *fakeTracer) SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(activeSpanKey{}).(*fakeSpan); ok {
+		return span
+	}
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := map[string]string{
+		"00-" + testTraceID + "-00f067aa0ba902b7-01":              testTraceID,
+		" 00-" + testTraceID + "-00f067aa0ba902b7-00 ":            testTraceID,
+		"01-" + testTraceID + "-00f067aa0ba902b7-01-future":       testTraceID,
+		"00-" + testTraceID + "-00f067aa0ba902b7-01-extra":        "",
+		"ff-" + testTraceID + "-00f067aa0ba902b7-01":              "",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-" + testTraceID + "-0000000000000000-01":              "",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01": "",
+		"00-" + testTraceID[:31] + "-00f067aa0ba902b7-01":         "",
+		"": "",
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, parseTraceparent(header), header)
+	}
+}
+
+func TestInterceptRequest_ReportsTraceparentTraceID(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodPost, Url: "/orders"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {})
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req.Header.Set("traceparent", "00-"+testTraceID+"-00f067aa0ba902b7-01")
+	api.HTTPInterceptor()(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotEmpty(t, manager.sentMessages)
+	payload, ok := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+	require.True(t, ok)
+	assert.Equal(t, testTraceID, payload.Metadata["traceId"])
+}
+
+func TestWithTracer_SpansAroundAllocationAndSettlement(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	tracer := &fakeTracer{}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodPost, Url: "/orders"})
+	api.tracer = tracer
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {})
+	server := &fakeSpan{name: "server", traceID: testTraceID, attrs: map[string]any{}}
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req = req.WithContext(context.WithValue(req.Context(), activeSpanKey{}, server))
+	api.HTTPInterceptor()(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	requestID := server.attrs[AttributeRequestID]
+	assert.NotEmpty(t, requestID)
+	assert.Equal(t, "POST /orders", server.attrs[AttributeAlias])
+	assert.Equal(t, float64(1), server.attrs[AttributeAmount])
+	assert.False(t, server.ended, "the active span belongs to the caller")
+
+	require.Len(t, tracer.spans, 2)
+	allocate, settle := tracer.spans[0], tracer.spans[1]
+	assert.Equal(t, SpanAllocate, allocate.name)
+	assert.Equal(t, requestID, allocate.attrs[AttributeRequestID])
+	assert.Equal(t, false, allocate.attrs[AttributeRateLimited])
+	assert.NotEmpty(t, allocate.attrs[AttributeAllocationID])
+	assert.True(t, allocate.ended)
+	assert.Equal(t, SpanSettle, settle.name)
+	assert.Equal(t, "POST /orders", settle.attrs[AttributeAlias])
+	assert.Equal(t, float64(1), settle.attrs[AttributeAmount])
+	assert.True(t, settle.ended)
+
+	require.NotEmpty(t, manager.sentMessages)
+	payload := manager.sentMessages[0].Payload.(*socket.RequestForAllocation)
+	assert.Equal(t, testTraceID, payload.Metadata["traceId"])
+}
+
+func TestWithTracer_RoundTripsRunUnderTheirSpans(t *testing.T) {
+	manager := &fakeSocketManager{
+		connected: true,
+		responses: []*socket.UsageFlowSocketResponse{
+			{Type: "success", Payload: map[string]interface{}{"allocationId": "allocation-1"}},
+			{Type: "success"},
+		},
+	}
+	tracer := &fakeTracer{}
+	api := newTestAPI(manager, config.ApiConfigStrategy{Method: http.MethodPost, Url: "/orders", HasRateLimit: true})
+	api.tracer = tracer
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {})
+	api.HTTPInterceptor()(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/orders", nil))
+
+	require.NotEmpty(t, tracer.spans)
+	require.Len(t, manager.asyncContexts, 2)
+	for _, ctx := range manager.asyncContexts {
+		assert.Same(t, tracer.spans[0], tracer.SpanFromContext(ctx), "transport calls nest under usageflow.allocate")
+	}
+}
@@ -16,7 +16,7 @@ func TestRequestInterceptor_TracksWrappedFunction(t *testing.T) {
 	tracker.Enable()
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	// Empty monitoring map → early c.Next(), but tracking context still active.
 	api.monitoringPathsMap = map[string]map[string]bool{}
@@ -53,13 +53,13 @@ func TestBeginTrackingDisabled(t *testing.T) {
 	t.Cleanup(tracker.Enable)
 
 	api := New("test-api-key")
-	defer api.socketManager.Close()
+	defer api.transport.Close()
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
 	c.Request = httptest.NewRequest(http.MethodGet, "/x", nil)
 
-	store := api.beginTracking(c, "GET", "/x")
+	store := api.beginTracking(ginRequest{c: c}, "GET", "/x")
 	assert.Nil(t, store)
 	assert.Nil(t, tracker.FromContext(c.Request.Context()))
 }
@@ -1,9 +1,13 @@
 package middleware
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
@@ -13,24 +17,61 @@ import (
 
 // StartConfigUpdater begins periodic updates of the API configuration.
 // Fetches run sequentially on one goroutine so WebSocket writes are not raced.
+// Server-pushed invalidations trigger an immediate refetch of the affected
+// section between polls. The updater stops when Shutdown is called.
 func (u *UsageFlowAPI) StartConfigUpdater() {
 	u.updaterOnce.Do(func() {
+		stop := u.stopCh()
+		refresh := u.refreshCh()
+		u.background.Add(1)
 		go func() {
+			defer u.background.Done()
 			fetchAll := func() {
-				_, _ = u.FetchApiConfig()
-				_ = u.FetchBlockedEndpoints()
-				_, _ = u.FetchApplicationConfig()
+				u.fetch(refreshAll)
 			}
 			fetchAll()
-			ticker := time.NewTicker(30 * time.Second)
+			close(u.configReadyCh())
+			interval := u.configRefreshInterval
+			if interval <= 0 {
+				interval = defaultConfigRefreshInterval
+			}
+			ticker := time.NewTicker(interval)
 			defer ticker.Stop()
-			for range ticker.C {
-				fetchAll()
+			for {
+				select {
+				case <-ticker.C:
+					fetchAll()
+				case <-refresh:
+					u.fetch(refreshTarget(u.pendingRefresh.Swap(0)))
+				case <-stop:
+					return
+				}
 			}
 		}()
 	})
 }
 
+// WaitForConfig blocks until the first policy, blocked endpoint and route
+// config fetch has finished (whether or not UsageFlow answered) or ctx is
+// done, e.g. to hold readiness until rate limits are known.
+func (u *UsageFlowAPI) WaitForConfig(ctx context.Context) error {
+	select {
+	case <-u.configReadyCh():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// configReadyCh returns the channel closed after the first config fetch,
+// created lazily like stopCh.
+func (u *UsageFlowAPI) configReadyCh() chan struct{} {
+	u.configInit.Do(func() {
+		u.configReady = make(chan struct{})
+	})
+	return u.configReady
+}
+
 // GetPatternedURL returns a standardized URL pattern for the current request
 func GetPatternedURL(c *gin.Context) string {
 	// You can implement custom URL pattern matching here
@@ -45,7 +86,11 @@ func GetPatternedURL(c *gin.Context) string {
 
 // ExtractBearerToken extracts the bearer token from the Authorization header
 func ExtractBearerToken(c *gin.Context) (string, error) {
-	authHeader := c.GetHeader("Authorization")
+	return extractBearerToken(c.Request)
+}
+
+func extractBearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return "", fmt.Errorf("Authorization header is missing")
 	}
@@ -98,6 +143,21 @@ func GetRequestBody(c *gin.Context) (string, error) {
 	return string(body), nil
 }
 
+// readRequestBody reads the full request body and restores it so downstream
+// handlers can read it again.
+func readRequestBody(rc requestContext) ([]byte, error) {
+	r := rc.Request()
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
 func ConvertToType[T any](obj any) (T, error) {
 	var zero T
 
@@ -118,12 +178,12 @@ func ConvertToType[T any](obj any) (T, error) {
 // GetCookieValue extracts a specific cookie value from the Cookie header
 // It handles both "cookie" and "Cookie" header names (case-insensitive)
 func GetCookieValue(c *gin.Context, cookieName string) string {
-	// Try lowercase first
-	cookieHeader := c.GetHeader("cookie")
-	if cookieHeader == "" {
-		// Try capitalized
-		cookieHeader = c.GetHeader("Cookie")
-	}
+	return getCookieValue(c.Request, cookieName)
+}
+
+func getCookieValue(r *http.Request, cookieName string) string {
+	// Header.Get canonicalizes, so "cookie" and "Cookie" are the same lookup.
+	cookieHeader := r.Header.Get("Cookie")
 	if cookieHeader == "" {
 		return ""
 	}
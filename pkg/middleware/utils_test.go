@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -407,3 +409,17 @@ func TestParseJwtCookieField(t *testing.T) {
 		})
 	}
 }
+
+func TestWaitForConfig(t *testing.T) {
+	manager := &fakeSocketManager{connected: true}
+	api := newTestAPI(manager)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, api.WaitForConfig(ctx), context.DeadlineExceeded, "updater not started yet")
+
+	api.StartConfigUpdater()
+	assert.NoError(t, api.WaitForConfig(context.Background()))
+	_, err := api.Shutdown(context.Background())
+	assert.NoError(t, err)
+}
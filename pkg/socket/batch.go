@@ -0,0 +1,129 @@
+package socket
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultBatchInterval = 50 * time.Millisecond
+
+// batcher coalesces Send messages into "batch" frames.
+type batcher struct {
+	mu      sync.Mutex
+	pending []*UsageFlowSocketMessage
+	// closed is set under mu by Close, so no message is appended and no
+	// flusher is started once Close waits for the flusher.
+	closed bool
+	kick   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// batching reports whether Send should batch: it must be configured and
+// the server must have advertised the "batch" capability.
+func (m *UsageFlowSocketManager) batching() bool {
+	return m.config.BatchSize > 1 && m.ServerInfo().Supports(CapabilityBatch)
+}
+
+// startBatcher starts the goroutine that flushes batches every
+// BatchInterval or as soon as BatchSize messages are queued. Callers hold
+// batch.mu.
+func (m *UsageFlowSocketManager) startBatcher() {
+	m.batch.once.Do(func() {
+		m.batch.kick = make(chan struct{}, 1)
+		m.batch.wg.Add(1)
+		go func() {
+			defer m.batch.wg.Done()
+			ticker := time.NewTicker(m.config.BatchInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-m.batch.kick:
+				case <-m.done:
+					m.flushBatch()
+					return
+				}
+				m.flushBatch()
+			}
+		}()
+	})
+}
+
+// enqueue adds msg to the current batch.
+func (m *UsageFlowSocketManager) enqueue(msg *UsageFlowSocketMessage) error {
+	if m.closed.Load() {
+		return ErrClosed
+	}
+	if !m.IsConnected() {
+		return errNotConnected
+	}
+
+	m.batch.mu.Lock()
+	if m.batch.closed {
+		m.batch.mu.Unlock()
+		return ErrClosed
+	}
+	m.startBatcher()
+	m.batch.pending = append(m.batch.pending, msg)
+	full := len(m.batch.pending) >= m.config.BatchSize
+	m.batch.mu.Unlock()
+
+	if full {
+		select {
+		case m.batch.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// flushBatch writes queued messages as batch frames of at most BatchSize.
+// Messages of a batch that cannot be written are reported to OnUndelivered
+// subscribers.
+func (m *UsageFlowSocketManager) flushBatch() {
+	for {
+		m.batch.mu.Lock()
+		n := len(m.batch.pending)
+		if n == 0 {
+			m.batch.mu.Unlock()
+			return
+		}
+		if n > m.config.BatchSize {
+			n = m.config.BatchSize
+		}
+		messages := m.batch.pending[:n:n]
+		m.batch.pending = m.batch.pending[n:]
+		m.batch.mu.Unlock()
+
+		frame := &UsageFlowSocketMessage{
+			Type:    MessageTypeBatch,
+			Payload: &BatchPayload{Messages: messages},
+		}
+		if err := m.writeFrame(frame); err != nil {
+			m.config.Logger.Warn("usageflow: failed to send batch", "messages", len(messages), "error", err)
+			m.emitUndelivered(messages, err)
+		}
+	}
+}
+
+// stopBatcher makes enqueue fail with ErrClosed from now on.
+func (m *UsageFlowSocketManager) stopBatcher() {
+	m.batch.mu.Lock()
+	m.batch.closed = true
+	m.batch.mu.Unlock()
+}
+
+// drainBatcher waits for the flusher's final flush, which runs once the
+// manager is done, and reports anything left behind as undelivered.
+func (m *UsageFlowSocketManager) drainBatcher() {
+	m.batch.wg.Wait()
+
+	m.batch.mu.Lock()
+	left := m.batch.pending
+	m.batch.pending = nil
+	m.batch.mu.Unlock()
+	if len(left) > 0 {
+		m.emitUndelivered(left, ErrClosed)
+	}
+}
@@ -0,0 +1,116 @@
+package socket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageFlowSocketManager_BatchesSends(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	frames := make(chan UsageFlowSocketMessage, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg, CapabilityBatch) {
+				continue
+			}
+			frames <- msg
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:           "ws" + server.URL[4:],
+		PoolSize:      1,
+		BatchSize:     3,
+		BatchInterval: time.Hour,
+	})
+
+	for _, kind := range []string{"request_for_allocation", "use_allocation", "report_call_chain", "request_for_allocation"} {
+		require.NoError(t, manager.Send(&UsageFlowSocketMessage{Type: kind}))
+	}
+
+	batchTypes := func(frame UsageFlowSocketMessage) []string {
+		require.Equal(t, MessageTypeBatch, frame.Type)
+		raw, err := json.Marshal(frame.Payload)
+		require.NoError(t, err)
+		var payload BatchPayload
+		require.NoError(t, json.Unmarshal(raw, &payload))
+		var types []string
+		for _, msg := range payload.Messages {
+			types = append(types, msg.Type)
+		}
+		return types
+	}
+
+	select {
+	case frame := <-frames:
+		assert.Equal(t, []string{"request_for_allocation", "use_allocation", "report_call_chain"}, batchTypes(frame))
+	case <-time.After(2 * time.Second):
+		t.Fatal("full batch was not flushed")
+	}
+
+	// Close flushes the partial batch before the pool shuts down.
+	manager.Close()
+	select {
+	case frame := <-frames:
+		assert.Equal(t, []string{"request_for_allocation"}, batchTypes(frame))
+	case <-time.After(2 * time.Second):
+		t.Fatal("partial batch was not flushed on Close")
+	}
+	assert.ErrorIs(t, manager.Send(&UsageFlowSocketMessage{Type: "use_allocation"}), ErrClosed)
+}
+
+func TestUsageFlowSocketManager_BatchingRequiresConnection(t *testing.T) {
+	manager := &UsageFlowSocketManager{config: Config{BatchSize: 10}.withDefaults()}
+	assert.Equal(t, defaultBatchInterval, manager.config.BatchInterval)
+	assert.Error(t, manager.Send(&UsageFlowSocketMessage{Type: "use_allocation"}))
+}
+
+func TestUsageFlowSocketManager_FailedBatchIsReported(t *testing.T) {
+	manager := &UsageFlowSocketManager{config: Config{BatchSize: 10}.withDefaults()}
+	var lost []*UsageFlowSocketMessage
+	var lostErr error
+	manager.OnUndelivered(func(msgs []*UsageFlowSocketMessage, err error) {
+		lost, lostErr = msgs, err
+	})
+
+	pending := []*UsageFlowSocketMessage{{Type: "use_allocation"}, {Type: "report_call_chain"}}
+	manager.batch.pending = append(manager.batch.pending, pending...)
+	manager.flushBatch()
+
+	assert.Equal(t, pending, lost)
+	assert.ErrorIs(t, lostErr, errNotConnected)
+	assert.Empty(t, manager.batch.pending)
+}
+
+func TestUsageFlowSocketManager_CloseReportsUnflushedBatch(t *testing.T) {
+	manager := &UsageFlowSocketManager{config: Config{BatchSize: 10}.withDefaults(), done: make(chan struct{})}
+	var lost []*UsageFlowSocketMessage
+	manager.OnUndelivered(func(msgs []*UsageFlowSocketMessage, err error) {
+		assert.ErrorIs(t, err, ErrClosed)
+		lost = append(lost, msgs...)
+	})
+
+	pending := []*UsageFlowSocketMessage{{Type: "use_allocation"}}
+	manager.batch.pending = append(manager.batch.pending, pending...)
+	manager.Close()
+
+	assert.Equal(t, pending, lost, "messages the flusher never wrote are reported")
+	assert.True(t, manager.batch.closed)
+}
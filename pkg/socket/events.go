@@ -0,0 +1,197 @@
+package socket
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionEvent reports a state change of one pooled connection.
+type ConnectionEvent struct {
+	// Index is the pool slot that changed.
+	Index int
+	// Old and New are the slot states before and after the change.
+	Old ConnectionState
+	New ConnectionState
+	// Err is the dial, read or close error behind a drop, if any.
+	Err error
+	// Healthy is the number of pool connections that are up after the change.
+	Healthy int
+}
+
+// stateListeners holds OnStateChange subscribers.
+type stateListeners struct {
+	mu     sync.Mutex
+	nextID int
+	fns    map[int]func(ConnectionEvent)
+}
+
+// OnStateChange registers fn to be called on every connection state change
+// (connecting, connected, dropped, closed). Events are delivered
+// synchronously on the goroutine that changed the state, so fn should
+// return quickly; events of different slots may arrive concurrently. fn may
+// call back into the manager, including Close and its own unsubscribe. The
+// returned function unsubscribes fn.
+func (m *UsageFlowSocketManager) OnStateChange(fn func(ConnectionEvent)) func() {
+	m.listeners.mu.Lock()
+	defer m.listeners.mu.Unlock()
+	if m.listeners.fns == nil {
+		m.listeners.fns = make(map[int]func(ConnectionEvent))
+	}
+	id := m.listeners.nextID
+	m.listeners.nextID++
+	m.listeners.fns[id] = fn
+	return func() {
+		m.listeners.mu.Lock()
+		defer m.listeners.mu.Unlock()
+		delete(m.listeners.fns, id)
+	}
+}
+
+// emit delivers event to all subscribers. Listeners are called after the
+// lock is released, so they may subscribe, unsubscribe or close the manager.
+func (m *UsageFlowSocketManager) emit(event ConnectionEvent) {
+	m.listeners.mu.Lock()
+	fns := make([]func(ConnectionEvent), 0, len(m.listeners.fns))
+	for _, fn := range m.listeners.fns {
+		fns = append(fns, fn)
+	}
+	m.listeners.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(event)
+	}
+}
+
+// HealthyConnections reports how many pool connections are up.
+func (m *UsageFlowSocketManager) HealthyConnections() int {
+	return m.healthyConnections()
+}
+
+// SlotStatus describes one pool slot.
+type SlotStatus struct {
+	Index int             `json:"index"`
+	State ConnectionState `json:"state"`
+	// Since is when the slot entered State.
+	Since time.Time `json:"since"`
+	// Attempt counts failed redials since the slot was last connected.
+	Attempt   int    `json:"attempt"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Slots reports the state of every pool slot.
+func (m *UsageFlowSocketManager) Slots() []SlotStatus {
+	m.mu.RLock()
+	slots := append([]*connectionSlot(nil), m.slots...)
+	m.mu.RUnlock()
+
+	statuses := make([]SlotStatus, len(slots))
+	for i, slot := range slots {
+		slot.mu.Lock()
+		statuses[i] = SlotStatus{Index: i, State: slot.state, Since: slot.since, Attempt: slot.attempt}
+		if slot.lastError != nil {
+			statuses[i].LastError = slot.lastError.Error()
+		}
+		slot.mu.Unlock()
+	}
+	return statuses
+}
+
+// healthyConnections counts pool connections that are up.
+func (m *UsageFlowSocketManager) healthyConnections() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, conn := range m.connections {
+		conn.mu.RLock()
+		if conn.connected {
+			n++
+		}
+		conn.mu.RUnlock()
+	}
+	return n
+}
+
+// pushListeners holds OnPush subscribers.
+type pushListeners struct {
+	mu     sync.Mutex
+	nextID int
+	fns    map[int]func(*UsageFlowSocketResponse)
+}
+
+// OnPush registers fn for unsolicited server messages, i.e. messages that
+// don't answer a pending SendAsync (for example "config_updated"). fn runs
+// on the connection's read goroutine and must return quickly; it may call
+// back into the manager, including its own unsubscribe. The returned
+// function unsubscribes fn.
+func (m *UsageFlowSocketManager) OnPush(fn func(*UsageFlowSocketResponse)) func() {
+	m.pushes.mu.Lock()
+	defer m.pushes.mu.Unlock()
+	if m.pushes.fns == nil {
+		m.pushes.fns = make(map[int]func(*UsageFlowSocketResponse))
+	}
+	id := m.pushes.nextID
+	m.pushes.nextID++
+	m.pushes.fns[id] = fn
+	return func() {
+		m.pushes.mu.Lock()
+		defer m.pushes.mu.Unlock()
+		delete(m.pushes.fns, id)
+	}
+}
+
+// emitPush delivers msg to all subscribers, outside the lock as in emit.
+func (m *UsageFlowSocketManager) emitPush(msg *UsageFlowSocketResponse) {
+	m.pushes.mu.Lock()
+	fns := make([]func(*UsageFlowSocketResponse), 0, len(m.pushes.fns))
+	for _, fn := range m.pushes.fns {
+		fns = append(fns, fn)
+	}
+	m.pushes.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(msg)
+	}
+}
+
+// undeliveredListeners holds OnUndelivered subscribers.
+type undeliveredListeners struct {
+	mu     sync.Mutex
+	nextID int
+	fns    map[int]func([]*UsageFlowSocketMessage, error)
+}
+
+// OnUndelivered registers fn for messages that Send accepted but the
+// manager failed to write later, such as a batch whose frame write failed.
+// The caller can spool or count them; Send already returned nil for them.
+// fn runs on the goroutine that lost the messages and must return quickly.
+// The returned function unsubscribes fn.
+func (m *UsageFlowSocketManager) OnUndelivered(fn func(msgs []*UsageFlowSocketMessage, err error)) func() {
+	m.undelivered.mu.Lock()
+	defer m.undelivered.mu.Unlock()
+	if m.undelivered.fns == nil {
+		m.undelivered.fns = make(map[int]func([]*UsageFlowSocketMessage, error))
+	}
+	id := m.undelivered.nextID
+	m.undelivered.nextID++
+	m.undelivered.fns[id] = fn
+	return func() {
+		m.undelivered.mu.Lock()
+		defer m.undelivered.mu.Unlock()
+		delete(m.undelivered.fns, id)
+	}
+}
+
+// emitUndelivered reports lost messages to all subscribers, outside the
+// lock as in emit.
+func (m *UsageFlowSocketManager) emitUndelivered(msgs []*UsageFlowSocketMessage, err error) {
+	m.undelivered.mu.Lock()
+	fns := make([]func([]*UsageFlowSocketMessage, error), 0, len(m.undelivered.fns))
+	for _, fn := range m.undelivered.fns {
+		fns = append(fns, fn)
+	}
+	m.undelivered.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(msgs, err)
+	}
+}
@@ -0,0 +1,161 @@
+package socket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultFallbackAfter = 30 * time.Second
+
+// FallbackTransport prefers the WebSocket pool and switches to an
+// HTTPTransport once the pool has been unable to connect for the configured
+// period. It switches back as soon as a WebSocket connection is up again;
+// the pool keeps redialing in the background while the fallback is active.
+// The outage is timed from the pool's state changes, not from traffic.
+type FallbackTransport struct {
+	primary     *UsageFlowSocketManager
+	fallback    *HTTPTransport
+	after       time.Duration
+	mu          sync.Mutex
+	downSince   time.Time
+	active      bool
+	unsubscribe func()
+}
+
+// NewFallbackTransport wraps primary and fallback. after is how long the
+// pool must be disconnected before traffic moves to HTTP (default 30s).
+func NewFallbackTransport(primary *UsageFlowSocketManager, fallback *HTTPTransport, after time.Duration) *FallbackTransport {
+	if after <= 0 {
+		after = defaultFallbackAfter
+	}
+	t := &FallbackTransport{
+		primary:  primary,
+		fallback: fallback,
+		after:    after,
+	}
+	t.unsubscribe = primary.OnStateChange(t.onStateChange)
+	t.mu.Lock()
+	if t.downSince.IsZero() && !primary.IsConnected() {
+		t.downSince = time.Now()
+	}
+	t.mu.Unlock()
+	return t
+}
+
+// onStateChange starts the outage clock when the last pool connection drops
+// and stops it when one comes back up.
+func (t *FallbackTransport) onStateChange(e ConnectionEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e.Healthy > 0 {
+		t.downSince = time.Time{}
+	} else if t.downSince.IsZero() {
+		t.downSince = time.Now()
+	}
+}
+
+// usingFallback reports whether traffic should go to the HTTP transport,
+// switching over or back based on the pool's state.
+func (t *FallbackTransport) usingFallback() bool {
+	connected := t.primary.IsConnected()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if connected {
+		if t.active {
+			t.primary.config.Logger.Info("usageflow: websocket reconnected, leaving HTTP fallback")
+		}
+		t.downSince = time.Time{}
+		t.active = false
+		return false
+	}
+	if t.downSince.IsZero() {
+		// The drop has not been reported yet.
+		return t.active
+	}
+	now := time.Now()
+	if !t.active && now.Sub(t.downSince) >= t.after {
+		t.primary.config.Logger.Warn("usageflow: websocket unavailable, switching to HTTP fallback", "down_for", now.Sub(t.downSince))
+		t.active = true
+	}
+	return t.active
+}
+
+// Send delivers msg over the active transport.
+func (t *FallbackTransport) Send(msg *UsageFlowSocketMessage) error {
+	if t.usingFallback() {
+		return t.fallback.Send(msg)
+	}
+	return t.primary.Send(msg)
+}
+
+// SendAsyncContext sends msg over the active transport and waits for the
+// response.
+func (t *FallbackTransport) SendAsyncContext(ctx context.Context, msg *UsageFlowSocketMessage) (*UsageFlowSocketResponse, error) {
+	if t.usingFallback() {
+		return t.fallback.SendAsyncContext(ctx, msg)
+	}
+	return t.primary.SendAsyncContext(ctx, msg)
+}
+
+// SendDirect writes msg synchronously over the active transport, bypassing
+// batching and buffering.
+func (t *FallbackTransport) SendDirect(msg *UsageFlowSocketMessage) error {
+	if t.usingFallback() {
+		return t.fallback.SendDirect(msg)
+	}
+	return t.primary.SendDirect(msg)
+}
+
+// IsConnected reports whether the active transport can deliver messages.
+func (t *FallbackTransport) IsConnected() bool {
+	if t.usingFallback() {
+		return t.fallback.IsConnected()
+	}
+	return t.primary.IsConnected()
+}
+
+// UsingFallback reports whether traffic currently goes over HTTP.
+func (t *FallbackTransport) UsingFallback() bool {
+	return t.usingFallback()
+}
+
+// OnPush subscribes fn to unsolicited messages from the WebSocket pool. The
+// HTTP fallback has no server push.
+func (t *FallbackTransport) OnPush(fn func(*UsageFlowSocketResponse)) func() {
+	return t.primary.OnPush(fn)
+}
+
+// OnStateChange subscribes fn to the WebSocket pool's connection events.
+func (t *FallbackTransport) OnStateChange(fn func(ConnectionEvent)) func() {
+	return t.primary.OnStateChange(fn)
+}
+
+// OnUndelivered subscribes fn to messages the WebSocket pool accepted but
+// failed to write.
+func (t *FallbackTransport) OnUndelivered(fn func([]*UsageFlowSocketMessage, error)) func() {
+	return t.primary.OnUndelivered(fn)
+}
+
+// HealthyConnections reports how many WebSocket pool connections are up.
+func (t *FallbackTransport) HealthyConnections() int {
+	return t.primary.HealthyConnections()
+}
+
+// Slots reports the state of every WebSocket pool slot.
+func (t *FallbackTransport) Slots() []SlotStatus {
+	return t.primary.Slots()
+}
+
+// QueueStats reports the WebSocket pool's outbound queue counters.
+func (t *FallbackTransport) QueueStats() QueueStats {
+	return t.primary.QueueStats()
+}
+
+// Close closes both transports, flushing events buffered for HTTP.
+func (t *FallbackTransport) Close() {
+	t.unsubscribe()
+	t.primary.Close()
+	t.fallback.Close()
+}
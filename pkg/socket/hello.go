@@ -0,0 +1,150 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+const (
+	// AgentVersion is the version reported in the hello handshake. It
+	// matches the VERSION file of this module.
+	AgentVersion = "2.5.7"
+	// ProtocolVersion is the wire protocol version this agent speaks.
+	ProtocolVersion = 1
+	// MinServerProtocolVersion is the oldest server protocol this agent
+	// can talk to.
+	MinServerProtocolVersion = 1
+)
+
+// Capabilities advertised in the hello handshake. A feature is only used
+// when both sides advertise it.
+const (
+	CapabilityBatch       = "batch"
+	CapabilityPushConfig  = "push_config"
+	CapabilityCompression = "compression"
+)
+
+// MessageTypeHello is the type of the handshake message sent on every new
+// connection, and of the server's reply.
+const MessageTypeHello = "hello"
+
+// ErrIncompatibleProtocol is returned when the server's protocol version
+// range does not include this agent's.
+var ErrIncompatibleProtocol = errors.New("incompatible UsageFlow protocol version")
+
+// HelloPayload is the payload of the "hello" message the agent sends.
+type HelloPayload struct {
+	AgentVersion    string   `json:"agentVersion"`
+	ProtocolVersion int      `json:"protocolVersion"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+// HelloResponse is the payload of the server's "hello" reply.
+type HelloResponse struct {
+	ProtocolVersion    int      `json:"protocolVersion"`
+	MinProtocolVersion int      `json:"minProtocolVersion,omitempty"`
+	Capabilities       []string `json:"capabilities"`
+}
+
+// ServerInfo describes what the server negotiated on the latest connection
+// that completed the handshake.
+type ServerInfo struct {
+	// Negotiated is false until a server answers the hello; servers that
+	// predate the handshake never do, and optional features stay off.
+	Negotiated      bool
+	ProtocolVersion int
+	Capabilities    []string
+}
+
+// Supports reports whether the server advertised capability.
+func (s ServerInfo) Supports(capability string) bool {
+	return s.Negotiated && slices.Contains(s.Capabilities, capability)
+}
+
+// capabilities lists what this agent offers given its config.
+func (m *UsageFlowSocketManager) capabilities() []string {
+	caps := []string{CapabilityPushConfig}
+	if m.config.BatchSize > 1 {
+		caps = append(caps, CapabilityBatch)
+	}
+	if m.config.EnableCompression {
+		caps = append(caps, CapabilityCompression)
+	}
+	return caps
+}
+
+// alert returns the logger for errors that must surface even when no
+// Config.Logger is set.
+func (m *UsageFlowSocketManager) alert() *slog.Logger {
+	if m.alertLogger != nil {
+		return m.alertLogger
+	}
+	return slog.Default()
+}
+
+// hello runs the handshake on a freshly dialed connection and records the
+// server's answer. It fails only when the versions are incompatible; a
+// server that does not answer with a hello within Config.HelloTimeout is
+// treated as a legacy server without optional capabilities.
+func (m *UsageFlowSocketManager) hello(conn *PooledConnection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.HelloTimeout)
+	defer cancel()
+	response, err := m.asyncSend(ctx, &UsageFlowSocketMessage{
+		Type: MessageTypeHello,
+		Payload: &HelloPayload{
+			AgentVersion:    AgentVersion,
+			ProtocolVersion: ProtocolVersion,
+			Capabilities:    m.capabilities(),
+		},
+	}, conn)
+
+	var reply HelloResponse
+	if err != nil || response.Type != MessageTypeHello || response.DecodePayload(&reply) != nil {
+		// One slow or garbled reply must not turn features off for
+		// connections that did negotiate them.
+		if m.negotiatedConns.Load() > 0 {
+			m.config.Logger.Info("usageflow: server did not answer the protocol handshake; keeping what other connections negotiated", "pool_index", conn.index)
+			return nil
+		}
+		if m.server.Swap(&ServerInfo{}) == nil {
+			m.config.Logger.Info("usageflow: server did not answer the protocol handshake; optional features disabled", "pool_index", conn.index)
+		}
+		return nil
+	}
+
+	if reply.ProtocolVersion < MinServerProtocolVersion || reply.MinProtocolVersion > ProtocolVersion {
+		err := fmt.Errorf("%w: agent speaks %d (server >= %d), server speaks %d (agent >= %d)",
+			ErrIncompatibleProtocol, ProtocolVersion, MinServerProtocolVersion, reply.ProtocolVersion, reply.MinProtocolVersion)
+		m.alert().Error("usageflow: "+err.Error(), "pool_index", conn.index, "agent_version", AgentVersion)
+		return err
+	}
+
+	info := &ServerInfo{
+		Negotiated:      true,
+		ProtocolVersion: reply.ProtocolVersion,
+		Capabilities:    reply.Capabilities,
+	}
+	m.server.Store(info)
+	conn.mu.Lock()
+	if conn.connected && !conn.negotiated {
+		conn.negotiated = true
+		m.negotiatedConns.Add(1)
+	}
+	if m.config.EnableCompression {
+		conn.ws.EnableWriteCompression(info.Supports(CapabilityCompression))
+	}
+	conn.mu.Unlock()
+	return nil
+}
+
+// ServerInfo reports what the server negotiated on the most recent
+// connection.
+func (m *UsageFlowSocketManager) ServerInfo() ServerInfo {
+	if info := m.server.Load(); info != nil {
+		return *info
+	}
+	return ServerInfo{}
+}
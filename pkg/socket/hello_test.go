@@ -0,0 +1,197 @@
+package socket
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helloServer answers the handshake with reply (or ignores it when reply is
+// nil) and forwards every message it receives to messages.
+func helloServer(t *testing.T, reply func(UsageFlowSocketMessage) UsageFlowSocketResponse) (*httptest.Server, chan UsageFlowSocketMessage) {
+	upgrader := websocket.Upgrader{}
+	messages := make(chan UsageFlowSocketMessage, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			messages <- msg
+			if msg.Type == MessageTypeHello {
+				_ = conn.WriteJSON(reply(msg))
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, messages
+}
+
+func TestHello_NegotiatesCapabilities(t *testing.T) {
+	server, messages := helloServer(t, func(msg UsageFlowSocketMessage) UsageFlowSocketResponse {
+		return UsageFlowSocketResponse{Type: MessageTypeHello, ReplyTo: msg.ID, Payload: HelloResponse{
+			ProtocolVersion: 2,
+			Capabilities:    []string{CapabilityBatch, CapabilityPushConfig},
+		}}
+	})
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:           "ws" + server.URL[4:],
+		PoolSize:      1,
+		BatchSize:     10,
+		BatchInterval: time.Millisecond,
+	})
+	defer manager.Close()
+
+	hello := <-messages
+	require.Equal(t, MessageTypeHello, hello.Type)
+	var payload HelloPayload
+	require.NoError(t, (&UsageFlowSocketResponse{Payload: hello.Payload}).DecodePayload(&payload))
+	assert.Equal(t, HelloPayload{
+		AgentVersion:    AgentVersion,
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []string{CapabilityPushConfig, CapabilityBatch},
+	}, payload)
+
+	info := manager.ServerInfo()
+	assert.True(t, info.Negotiated)
+	assert.Equal(t, 2, info.ProtocolVersion)
+	assert.True(t, info.Supports(CapabilityBatch))
+	assert.False(t, info.Supports(CapabilityCompression))
+
+	require.NoError(t, manager.Send(&UsageFlowSocketMessage{Type: "use_allocation"}))
+	assert.Equal(t, MessageTypeBatch, (<-messages).Type)
+}
+
+func TestHello_LegacyServerDisablesOptionalFeatures(t *testing.T) {
+	server, messages := helloServer(t, func(msg UsageFlowSocketMessage) UsageFlowSocketResponse {
+		return UsageFlowSocketResponse{Type: "error", ReplyTo: msg.ID, Message: "unknown message type"}
+	})
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:           "ws" + server.URL[4:],
+		PoolSize:      1,
+		BatchSize:     10,
+		BatchInterval: time.Millisecond,
+	})
+	defer manager.Close()
+	<-messages
+
+	assert.True(t, manager.IsConnected())
+	assert.False(t, manager.ServerInfo().Negotiated)
+	require.NoError(t, manager.Send(&UsageFlowSocketMessage{Type: "use_allocation"}))
+	assert.Equal(t, "use_allocation", (<-messages).Type, "batching needs the server's batch capability")
+}
+
+func TestHello_SilentServerDoesNotStallDial(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:            "ws" + server.URL[4:],
+		PoolSize:       1,
+		RequestTimeout: 5 * time.Second,
+		HelloTimeout:   50 * time.Millisecond,
+	})
+	defer manager.Close()
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, manager.IsConnected())
+	assert.False(t, manager.ServerInfo().Negotiated)
+}
+
+func TestHello_SilentConnectionKeepsPoolFeatures(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var dials atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		silent := dials.Add(1) == 2
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if !silent {
+				answerHello(conn, msg, CapabilityBatch)
+			}
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:          "ws" + server.URL[4:],
+		PoolSize:     2,
+		BatchSize:    10,
+		HelloTimeout: 50 * time.Millisecond,
+	})
+	defer manager.Close()
+
+	assert.Equal(t, 2, manager.HealthyConnections())
+	assert.True(t, manager.ServerInfo().Supports(CapabilityBatch), "one silent connection does not downgrade the pool")
+}
+
+func TestHello_IncompatibleProtocolFailsConnect(t *testing.T) {
+	server, messages := helloServer(t, func(msg UsageFlowSocketMessage) UsageFlowSocketResponse {
+		return UsageFlowSocketResponse{Type: MessageTypeHello, ReplyTo: msg.ID, Payload: HelloResponse{
+			ProtocolVersion:    3,
+			MinProtocolVersion: ProtocolVersion + 1,
+		}}
+	})
+
+	var logs bytes.Buffer
+	events := make(chan ConnectionEvent, 16)
+	t.Setenv("USAGEFLOW_DISABLE_WS", "1")
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:               "ws" + server.URL[4:],
+		PoolSize:          1,
+		ReconnectDelay:    time.Millisecond,
+		MaxReconnectDelay: time.Millisecond,
+		OnStateChange:     func(e ConnectionEvent) { events <- e },
+		Logger:            slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	defer manager.Close()
+
+	assert.ErrorIs(t, manager.Connect(), ErrIncompatibleProtocol)
+	assert.False(t, manager.IsConnected())
+	for e := range events {
+		if e.New == StateDisconnected {
+			assert.ErrorIs(t, e.Err, ErrIncompatibleProtocol)
+			break
+		}
+	}
+	assert.Contains(t, logs.String(), "incompatible UsageFlow protocol version")
+
+	<-messages
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, messages, "an incompatible server is not redialed")
+}
@@ -0,0 +1,292 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultMaxBuffered   = 10000
+)
+
+// HTTPConfig tunes the HTTP batch transport. Zero values fall back to the
+// package defaults.
+type HTTPConfig struct {
+	// URL is the batch ingestion endpoint. It is required; every POST fails
+	// without it.
+	URL string
+	// RequestTimeout bounds each POST, including SendAsyncContext round trips.
+	RequestTimeout time.Duration
+	// BatchSize flushes buffered events once this many are queued.
+	BatchSize int
+	// FlushInterval flushes buffered events at least this often.
+	FlushInterval time.Duration
+	// MaxBuffered caps events held while the endpoint is unreachable; Send
+	// fails once it is reached.
+	MaxBuffered int
+	// Client replaces the default HTTP client (e.g. custom proxy or TLS).
+	Client *http.Client
+	// Header adds request headers to every POST. x-usage-key is always set
+	// from the API key.
+	Header http.Header
+	// Logger receives transport diagnostics; nil discards them.
+	Logger *slog.Logger
+}
+
+func (c HTTPConfig) withDefaults() HTTPConfig {
+	if c.RequestTimeout <= 0 {
+		c.RequestTimeout = requestTimeout
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.MaxBuffered <= 0 {
+		c.MaxBuffered = defaultMaxBuffered
+	}
+	if c.MaxBuffered < c.BatchSize {
+		c.MaxBuffered = c.BatchSize
+	}
+	if c.Client == nil {
+		c.Client = &http.Client{}
+	}
+	if c.Logger == nil {
+		c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return c
+}
+
+// HTTPTransport delivers UsageFlow messages over plain HTTPS for networks
+// that block WebSocket upgrades. Fire-and-forget events are buffered and
+// POSTed in batches; SendAsyncContext POSTs a single message and returns
+// the correlated response.
+//
+// Every POST carries a JSON array of messages and the response is a JSON
+// array of replies, correlated by replyTo.
+type HTTPTransport struct {
+	apiKey    string
+	config    HTTPConfig
+	mu        sync.Mutex
+	buffer    []*UsageFlowSocketMessage
+	flushMu   sync.Mutex
+	healthy   atomic.Bool
+	kick      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closed    atomic.Bool
+	closeOnce sync.Once
+}
+
+// NewHTTPTransport creates an HTTP batch transport and starts its flusher.
+func NewHTTPTransport(apiKey string, cfg HTTPConfig) *HTTPTransport {
+	t := &HTTPTransport{
+		apiKey: apiKey,
+		config: cfg.withDefaults(),
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	t.healthy.Store(true)
+	t.wg.Add(1)
+	go t.flushLoop()
+	return t
+}
+
+// Send queues msg for the next batch.
+func (t *HTTPTransport) Send(msg *UsageFlowSocketMessage) error {
+	if t.closed.Load() {
+		return errors.New("HTTP transport closed")
+	}
+	t.mu.Lock()
+	if len(t.buffer) >= t.config.MaxBuffered {
+		t.mu.Unlock()
+		return errors.New("HTTP batch buffer full")
+	}
+	t.buffer = append(t.buffer, msg)
+	full := len(t.buffer) >= t.config.BatchSize
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// SendDirect POSTs msg immediately, bypassing the batch buffer, and returns
+// the delivery error.
+func (t *HTTPTransport) SendDirect(msg *UsageFlowSocketMessage) error {
+	if t.closed.Load() {
+		return errors.New("HTTP transport closed")
+	}
+	_, err := t.post(context.Background(), []*UsageFlowSocketMessage{msg})
+	return err
+}
+
+// SendAsyncContext POSTs msg immediately and waits for its reply until the
+// request timeout elapses or ctx is done.
+func (t *HTTPTransport) SendAsyncContext(ctx context.Context, msg *UsageFlowSocketMessage) (*UsageFlowSocketResponse, error) {
+	if t.closed.Load() {
+		return nil, errors.New("HTTP transport closed")
+	}
+	id, err := generateID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ID: %w", err)
+	}
+	message := &UsageFlowSocketMessage{
+		Type:    msg.Type,
+		Payload: msg.Payload,
+		ID:      id,
+	}
+
+	responses, err := t.post(ctx, []*UsageFlowSocketMessage{message})
+	if err != nil {
+		return nil, err
+	}
+	for _, response := range responses {
+		if response.ReplyTo == id || response.ID == id {
+			return response, nil
+		}
+	}
+	if len(responses) == 1 {
+		return responses[0], nil
+	}
+	return nil, errors.New("HTTP transport response missing reply")
+}
+
+// IsConnected reports whether the last POST reached the endpoint.
+func (t *HTTPTransport) IsConnected() bool {
+	return !t.closed.Load() && t.healthy.Load()
+}
+
+// Close flushes buffered events, giving up once one request timeout has
+// elapsed in total, and stops the flusher.
+func (t *HTTPTransport) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.wg.Wait()
+		t.closed.Store(true)
+
+		t.mu.Lock()
+		left := len(t.buffer)
+		t.mu.Unlock()
+		if left > 0 {
+			t.config.Logger.Warn("usageflow: HTTP transport closed with undelivered events", "dropped", left)
+		}
+	})
+}
+
+func (t *HTTPTransport) flushLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.kick:
+		case <-t.done:
+			ctx, cancel := context.WithTimeout(context.Background(), t.config.RequestTimeout)
+			t.flush(ctx)
+			cancel()
+			return
+		}
+		t.flush(context.Background())
+	}
+}
+
+// flush POSTs buffered events in BatchSize chunks until the buffer is empty
+// or ctx is done. A failed batch is put back at the head of the buffer so
+// ordering survives short outages.
+func (t *HTTPTransport) flush(ctx context.Context) {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+
+	for ctx.Err() == nil {
+		t.mu.Lock()
+		n := len(t.buffer)
+		if n == 0 {
+			t.mu.Unlock()
+			return
+		}
+		if n > t.config.BatchSize {
+			n = t.config.BatchSize
+		}
+		batch := make([]*UsageFlowSocketMessage, n)
+		copy(batch, t.buffer[:n])
+		t.buffer = t.buffer[n:]
+		t.mu.Unlock()
+
+		if _, err := t.post(ctx, batch); err != nil {
+			t.mu.Lock()
+			t.buffer = append(batch, t.buffer...)
+			if over := len(t.buffer) - t.config.MaxBuffered; over > 0 {
+				t.buffer = t.buffer[:t.config.MaxBuffered]
+				t.config.Logger.Warn("usageflow: HTTP batch buffer full, dropping events", "dropped", over)
+			}
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (t *HTTPTransport) post(ctx context.Context, messages []*UsageFlowSocketMessage) ([]*UsageFlowSocketResponse, error) {
+	if t.config.URL == "" {
+		return nil, errors.New("HTTP transport URL not configured")
+	}
+	body, err := json.Marshal(messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal messages: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.config.RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range t.config.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-usage-key", t.apiKey)
+
+	resp, err := t.config.Client.Do(req)
+	if err != nil {
+		t.markUnhealthy(err)
+		return nil, fmt.Errorf("failed to post messages: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("HTTP transport returned status %d", resp.StatusCode)
+		t.markUnhealthy(err)
+		return nil, err
+	}
+	t.healthy.Store(true)
+
+	var responses []*UsageFlowSocketResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return responses, nil
+}
+
+func (t *HTTPTransport) markUnhealthy(err error) {
+	if t.healthy.Swap(false) {
+		t.config.Logger.Warn("usageflow: HTTP transport request failed", "url", t.config.URL, "error", err)
+	}
+}
@@ -0,0 +1,153 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchServer records POSTed batches and replies to each message.
+type batchServer struct {
+	mu      sync.Mutex
+	batches [][]UsageFlowSocketMessage
+	keys    []string
+	status  int
+}
+
+func (s *batchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var messages []UsageFlowSocketMessage
+	if err := json.NewDecoder(r.Body).Decode(&messages); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.batches = append(s.batches, messages)
+	s.keys = append(s.keys, r.Header.Get("x-usage-key"))
+	status := s.status
+	s.mu.Unlock()
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	responses := make([]UsageFlowSocketResponse, 0, len(messages))
+	for _, msg := range messages {
+		responses = append(responses, UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID, Payload: map[string]interface{}{"echo": msg.Type}})
+	}
+	_ = json.NewEncoder(w).Encode(responses)
+}
+
+func (s *batchServer) snapshot() [][]UsageFlowSocketMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]UsageFlowSocketMessage(nil), s.batches...)
+}
+
+func TestHTTPTransport_BatchesBySize(t *testing.T) {
+	backend := &batchServer{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	transport := NewHTTPTransport("test-key", HTTPConfig{
+		URL:           server.URL,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+
+	require.NoError(t, transport.Send(&UsageFlowSocketMessage{Type: "request_for_allocation"}))
+	require.NoError(t, transport.Send(&UsageFlowSocketMessage{Type: "use_allocation"}))
+	assert.Eventually(t, func() bool { return len(backend.snapshot()) == 1 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, transport.Send(&UsageFlowSocketMessage{Type: "report_call_chain"}))
+
+	transport.Close()
+	batches := backend.snapshot()
+	require.Len(t, batches, 2, "Close flushes the partial batch")
+	assert.Equal(t, "request_for_allocation", batches[0][0].Type)
+	assert.Equal(t, "use_allocation", batches[0][1].Type)
+	assert.Equal(t, "report_call_chain", batches[1][0].Type)
+	assert.Equal(t, []string{"test-key", "test-key"}, backend.keys)
+	assert.Error(t, transport.Send(&UsageFlowSocketMessage{Type: "late"}))
+}
+
+func TestHTTPTransport_SendAsyncContext(t *testing.T) {
+	server := httptest.NewServer(&batchServer{})
+	defer server.Close()
+
+	transport := NewHTTPTransport("test-key", HTTPConfig{URL: server.URL})
+	defer transport.Close()
+
+	response, err := transport.SendAsyncContext(context.Background(), &UsageFlowSocketMessage{Type: "get_application_policies"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"echo": "get_application_policies"}, response.Payload)
+	assert.True(t, transport.IsConnected())
+}
+
+func TestHTTPTransport_FailureRequeuesAndMarksDown(t *testing.T) {
+	backend := &batchServer{status: http.StatusBadGateway}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	transport := NewHTTPTransport("test-key", HTTPConfig{
+		URL:           server.URL,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer transport.Close()
+
+	require.NoError(t, transport.Send(&UsageFlowSocketMessage{Type: "use_allocation"}))
+	assert.Eventually(t, func() bool { return !transport.IsConnected() }, time.Second, 5*time.Millisecond)
+
+	backend.mu.Lock()
+	backend.status = 0
+	backend.mu.Unlock()
+	assert.Eventually(t, transport.IsConnected, time.Second, 5*time.Millisecond)
+
+	transport.mu.Lock()
+	assert.Empty(t, transport.buffer, "requeued batch is delivered once the endpoint recovers")
+	transport.mu.Unlock()
+}
+
+func TestFallbackTransport_SwitchesAfterPeriod(t *testing.T) {
+	t.Setenv("USAGEFLOW_DISABLE_WS", "1")
+
+	backend := &batchServer{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	primary := NewUsageFlowSocketManagerWithConfig("test-key", Config{})
+	fallback := NewHTTPTransport("test-key", HTTPConfig{URL: server.URL})
+	transport := NewFallbackTransport(primary, fallback, 30*time.Millisecond)
+	defer transport.Close()
+
+	assert.False(t, transport.IsConnected(), "pool is down but the fallback period has not elapsed")
+	assert.False(t, transport.UsingFallback())
+	assert.Error(t, transport.Send(&UsageFlowSocketMessage{Type: "use_allocation"}))
+
+	time.Sleep(40 * time.Millisecond)
+	assert.True(t, transport.UsingFallback())
+	assert.True(t, transport.IsConnected())
+
+	response, err := transport.SendAsyncContext(context.Background(), &UsageFlowSocketMessage{Type: "get_blocked_endpoints"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", response.Type)
+}
+
+func TestFallbackTransport_TimesOutageFromStateChanges(t *testing.T) {
+	t.Setenv("USAGEFLOW_DISABLE_WS", "1")
+
+	primary := NewUsageFlowSocketManagerWithConfig("test-key", Config{})
+	fallback := NewHTTPTransport("test-key", HTTPConfig{URL: "http://127.0.0.1:0"})
+	transport := NewFallbackTransport(primary, fallback, 30*time.Millisecond)
+	defer transport.Close()
+
+	primary.emit(ConnectionEvent{Index: 0, Old: StateDisconnected, New: StateConnected, Healthy: 1})
+	primary.emit(ConnectionEvent{Index: 0, Old: StateConnected, New: StateDisconnected, Healthy: 0})
+	time.Sleep(40 * time.Millisecond)
+	assert.True(t, transport.UsingFallback(), "outage is timed from the drop, not from the first send")
+}
@@ -0,0 +1,248 @@
+package socket
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const defaultQueueTimeout = 50 * time.Millisecond
+
+// ErrQueueFull is returned by Send when a connection's outbound queue is
+// full and the overflow policy rejects the message.
+var ErrQueueFull = errors.New("outbound queue full")
+
+// OverflowPolicy decides what Send does when the outbound queue of the
+// selected connection is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest rejects the message being sent with ErrQueueFull.
+	DropNewest OverflowPolicy = iota
+	// DropOldest evicts the oldest queued message to make room.
+	DropOldest
+	// Block waits up to Config.QueueTimeout for room, then rejects the
+	// message with ErrQueueFull.
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop_newest"
+	case DropOldest:
+		return "drop_oldest"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// QueueStats reports outbound queue depth and loss counters. Loss counters
+// count messages, so a dropped batch frame adds its message count.
+type QueueStats struct {
+	// Depth is the number of frames waiting across all connections.
+	Depth int
+	// Rejected counts messages Send refused with ErrQueueFull.
+	Rejected uint64
+	// Evicted counts queued messages discarded by DropOldest.
+	Evicted uint64
+	// Undelivered counts queued messages lost because their connection
+	// closed or the write failed.
+	Undelivered uint64
+}
+
+// Dropped is the total number of messages lost to the queue.
+func (s QueueStats) Dropped() uint64 {
+	return s.Rejected + s.Evicted + s.Undelivered
+}
+
+// queueCounters holds the manager-wide QueueStats counters.
+type queueCounters struct {
+	rejected    atomic.Uint64
+	evicted     atomic.Uint64
+	undelivered atomic.Uint64
+	writers     sync.WaitGroup
+}
+
+// queuedFrame is an encoded frame and the messages it carries (more than
+// one for batch frames), kept so lost frames can be reported.
+type queuedFrame struct {
+	data []byte
+	msgs []*UsageFlowSocketMessage
+}
+
+// frameMessages returns the messages payload carries.
+func frameMessages(payload *UsageFlowSocketMessage) []*UsageFlowSocketMessage {
+	if batch, ok := payload.Payload.(*BatchPayload); ok {
+		return batch.Messages
+	}
+	return []*UsageFlowSocketMessage{payload}
+}
+
+// outboundQueue is the per-connection queue drained by writeLoop.
+type outboundQueue struct {
+	frames   chan queuedFrame
+	quit     chan struct{}
+	quitOnce sync.Once
+	// mu is read-held while pushing and write-held while the writer
+	// retires, so no frame is queued after the final drain.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+func (m *UsageFlowSocketManager) queueing() bool {
+	return m.config.QueueSize > 0
+}
+
+// startWriter gives conn an outbound queue and the goroutine that drains it.
+func (m *UsageFlowSocketManager) startWriter(conn *PooledConnection) {
+	conn.outbound = &outboundQueue{
+		frames: make(chan queuedFrame, m.config.QueueSize),
+		quit:   make(chan struct{}),
+	}
+	m.queue.writers.Add(1)
+	go m.writeLoop(conn)
+}
+
+// stopWriter asks conn's writer to write what is queued (if the connection
+// is still up) and exit.
+func (c *PooledConnection) stopWriter() {
+	if c.outbound == nil {
+		return
+	}
+	c.outbound.quitOnce.Do(func() {
+		close(c.outbound.quit)
+	})
+}
+
+// writeLoop writes queued frames in order. A failed write is counted as
+// undelivered and reported to OnUndelivered subscribers; the read loop
+// notices the broken connection and redials.
+func (m *UsageFlowSocketManager) writeLoop(conn *PooledConnection) {
+	defer m.queue.writers.Done()
+	q := conn.outbound
+	for {
+		select {
+		case frame := <-q.frames:
+			m.writeQueued(conn, frame)
+		case <-q.quit:
+			for {
+				select {
+				case frame := <-q.frames:
+					m.writeQueued(conn, frame)
+				default:
+					if q.retire() {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// retire marks the queue stopped if nothing is left to write. It reports
+// false when a push slipped in, so the writer drains again.
+func (q *outboundQueue) retire() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) > 0 {
+		return false
+	}
+	q.stopped = true
+	return true
+}
+
+func (m *UsageFlowSocketManager) writeQueued(conn *PooledConnection, frame queuedFrame) {
+	conn.mu.Lock()
+	err := errNotConnected
+	if conn.connected && conn.ws != nil {
+		conn.ws.SetWriteDeadline(time.Now().Add(m.config.WriteWait))
+		err = conn.ws.WriteMessage(websocket.TextMessage, frame.data)
+		if err != nil {
+			m.config.Logger.Warn("usageflow: queued write failed", "pool_index", conn.index, "error", err)
+		}
+	}
+	conn.mu.Unlock()
+
+	if err != nil {
+		m.queue.undelivered.Add(uint64(len(frame.msgs)))
+		m.emitUndelivered(frame.msgs, err)
+	}
+}
+
+// push adds frame to conn's queue, applying the overflow policy when full.
+// It fails with errNotConnected once the connection's writer has retired.
+func (m *UsageFlowSocketManager) push(conn *PooledConnection, frame queuedFrame) error {
+	evicted, err := m.enqueueFrame(conn.outbound, frame)
+	// Report evictions outside the queue lock; subscribers may Send.
+	for _, old := range evicted {
+		m.emitUndelivered(old.msgs, ErrQueueFull)
+	}
+	return err
+}
+
+func (m *UsageFlowSocketManager) enqueueFrame(q *outboundQueue, frame queuedFrame) ([]queuedFrame, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.stopped {
+		return nil, errNotConnected
+	}
+
+	select {
+	case q.frames <- frame:
+		return nil, nil
+	default:
+	}
+
+	switch m.config.OverflowPolicy {
+	case DropOldest:
+		var evicted []queuedFrame
+		for {
+			select {
+			case q.frames <- frame:
+				return evicted, nil
+			default:
+			}
+			select {
+			case old := <-q.frames:
+				m.queue.evicted.Add(uint64(len(old.msgs)))
+				evicted = append(evicted, old)
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(m.config.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case q.frames <- frame:
+			return nil, nil
+		case <-timer.C:
+		case <-m.done:
+		}
+	}
+	m.queue.rejected.Add(uint64(len(frame.msgs)))
+	return nil, ErrQueueFull
+}
+
+// QueueStats reports outbound queue depth and loss counters. All values are
+// zero unless Config.QueueSize is set.
+func (m *UsageFlowSocketManager) QueueStats() QueueStats {
+	stats := QueueStats{
+		Rejected:    m.queue.rejected.Load(),
+		Evicted:     m.queue.evicted.Load(),
+		Undelivered: m.queue.undelivered.Load(),
+	}
+	m.mu.RLock()
+	for _, conn := range m.connections {
+		if conn.outbound != nil {
+			stats.Depth += len(conn.outbound.frames)
+		}
+	}
+	m.mu.RUnlock()
+	return stats
+}
@@ -0,0 +1,146 @@
+package socket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledQueue returns a manager and a connection whose queue has no writer,
+// so it fills up.
+func stalledQueue(policy OverflowPolicy, timeout time.Duration) (*UsageFlowSocketManager, *PooledConnection) {
+	m := &UsageFlowSocketManager{
+		config: Config{QueueSize: 2, OverflowPolicy: policy, QueueTimeout: timeout}.withDefaults(),
+		done:   make(chan struct{}),
+	}
+	conn := &PooledConnection{outbound: &outboundQueue{frames: make(chan queuedFrame, 2), quit: make(chan struct{})}}
+	m.connections = []*PooledConnection{conn}
+	return m, conn
+}
+
+func frame(s string) queuedFrame {
+	return queuedFrame{data: []byte(s), msgs: []*UsageFlowSocketMessage{{Type: s}}}
+}
+
+func TestQueue_DropNewest(t *testing.T) {
+	m, conn := stalledQueue(DropNewest, 0)
+	require.NoError(t, m.push(conn, frame("1")))
+	require.NoError(t, m.push(conn, frame("2")))
+	assert.ErrorIs(t, m.push(conn, frame("3")), ErrQueueFull)
+
+	assert.Equal(t, QueueStats{Depth: 2, Rejected: 1}, m.QueueStats())
+	assert.Equal(t, "1", string((<-conn.outbound.frames).data))
+}
+
+func TestQueue_DropOldest(t *testing.T) {
+	m, conn := stalledQueue(DropOldest, 0)
+	var evicted []string
+	m.OnUndelivered(func(msgs []*UsageFlowSocketMessage, err error) {
+		assert.ErrorIs(t, err, ErrQueueFull)
+		for _, msg := range msgs {
+			evicted = append(evicted, msg.Type)
+		}
+	})
+	for _, s := range []string{"1", "2", "3"} {
+		require.NoError(t, m.push(conn, frame(s)))
+	}
+	require.NoError(t, m.push(conn, frame("4")))
+
+	assert.Equal(t, QueueStats{Depth: 2, Evicted: 2}, m.QueueStats())
+	assert.Equal(t, []string{"1", "2"}, evicted, "evicted messages are reported")
+	assert.Equal(t, "3", string((<-conn.outbound.frames).data))
+	assert.Equal(t, "4", string((<-conn.outbound.frames).data))
+}
+
+func TestQueue_BlockWithTimeout(t *testing.T) {
+	m, conn := stalledQueue(Block, 30*time.Millisecond)
+	require.NoError(t, m.push(conn, frame("1")))
+	require.NoError(t, m.push(conn, frame("2")))
+
+	start := time.Now()
+	assert.ErrorIs(t, m.push(conn, queuedFrame{data: []byte("batch"), msgs: make([]*UsageFlowSocketMessage, 5)}), ErrQueueFull)
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	assert.Equal(t, uint64(5), m.QueueStats().Rejected, "batch frames count their messages")
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-conn.outbound.frames
+	}()
+	assert.NoError(t, m.push(conn, frame("3")), "room freed within the timeout")
+}
+
+func TestQueue_UndeliveredFramesAreReported(t *testing.T) {
+	m, conn := stalledQueue(DropNewest, 0)
+	var lost []*UsageFlowSocketMessage
+	m.OnUndelivered(func(msgs []*UsageFlowSocketMessage, err error) {
+		assert.ErrorIs(t, err, errNotConnected)
+		lost = append(lost, msgs...)
+	})
+
+	f := frame("use_allocation")
+	m.writeQueued(conn, f)
+	assert.Equal(t, f.msgs, lost)
+	assert.Equal(t, uint64(1), m.QueueStats().Undelivered)
+}
+
+func TestQueue_PushAfterWriterRetiresFails(t *testing.T) {
+	m, conn := stalledQueue(DropNewest, 0)
+	m.queue.writers.Add(1)
+	conn.stopWriter()
+	go m.writeLoop(conn)
+	m.queue.writers.Wait()
+
+	assert.ErrorIs(t, m.push(conn, frame("late")), errNotConnected, "nothing is queued once the final drain is done")
+	assert.Zero(t, m.QueueStats().Depth)
+}
+
+func TestUsageFlowSocketManager_QueuedSendsDeliverInOrder(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	received := make(chan string, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+			received <- msg.Type
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:            "ws" + server.URL[4:],
+		PoolSize:       1,
+		QueueSize:      100,
+		OverflowPolicy: Block,
+	})
+	for i := 0; i < 50; i++ {
+		require.NoError(t, manager.Send(&UsageFlowSocketMessage{Type: fmt.Sprintf("event_%d", i)}))
+	}
+	// Close drains the queue before the connection goes away.
+	manager.Close()
+
+	for i := 0; i < 50; i++ {
+		select {
+		case got := <-received:
+			assert.Equal(t, fmt.Sprintf("event_%d", i), got)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of 50 queued messages delivered", i)
+		}
+	}
+	assert.Equal(t, uint64(0), manager.QueueStats().Dropped())
+}
@@ -1,17 +1,27 @@
 package socket
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"math/big"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/usageflow/usageflow-go-middleware/v2/internal/logging"
 )
 
 const (
@@ -23,9 +33,163 @@ const (
 	pingPeriod        = 30 * time.Second
 	pongWait          = 60 * time.Second
 	writeWait         = 10 * time.Second
-	maxReconnectTries = 5
+	handshakeTimeout  = 10 * time.Second
+	helloTimeout      = 500 * time.Millisecond
+	maxReconnectDelay = 60 * time.Second
 )
 
+// Config tunes the socket manager. Zero values fall back to the package
+// defaults, so callers only set what they need to override.
+type Config struct {
+	// URL is the WebSocket endpoint (default wss://api.usageflow.io/ws).
+	URL string
+	// PoolSize is the number of pooled connections, capped at 5.
+	PoolSize int
+	// RequestTimeout bounds SendAsync round trips.
+	RequestTimeout time.Duration
+	// ReconnectDelay is the base delay before redialing a dropped connection.
+	// It doubles after each failed attempt up to MaxReconnectDelay; every
+	// delay is jittered so replicas don't redial in lockstep.
+	ReconnectDelay time.Duration
+	// MaxReconnectDelay caps the redial backoff (default 60s). Redials never
+	// give up while the manager is open.
+	MaxReconnectDelay time.Duration
+	// PingPeriod, PongWait and WriteWait control keepalives and write deadlines.
+	PingPeriod time.Duration
+	PongWait   time.Duration
+	WriteWait  time.Duration
+	// HandshakeTimeout bounds the WebSocket opening handshake when Dialer is nil.
+	HandshakeTimeout time.Duration
+	// HelloTimeout bounds the wait for the server's protocol handshake reply
+	// on each new connection (default 500ms, at most RequestTimeout). A
+	// server that does not answer in time is treated as a legacy server.
+	HelloTimeout time.Duration
+	// Dialer replaces the default WebSocket dialer (e.g. custom NetDialContext).
+	// Proxy and TLSConfig are ignored when it is set.
+	Dialer *websocket.Dialer
+	// Proxy selects the outbound proxy for each dial (default
+	// http.ProxyFromEnvironment, i.e. HTTPS_PROXY and NO_PROXY). Userinfo in
+	// the proxy URL is sent as Basic Proxy-Authorization on CONNECT.
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLSConfig sets custom root CAs, client certificates for mTLS or other
+	// TLS settings for wss:// endpoints.
+	TLSConfig *tls.Config
+	// Header adds handshake headers. x-usage-key is always set from the API
+	// key and cannot be overridden.
+	Header http.Header
+	// Logger receives transport diagnostics; nil discards them, except
+	// errors that stop the agent from connecting at all, which go to
+	// slog.Default.
+	Logger *slog.Logger
+	// OnStateChange, if set, is subscribed before the first dial so the
+	// initial connection attempts are reported too.
+	OnStateChange func(ConnectionEvent)
+	// BatchSize > 1 coalesces Send messages into "batch" frames of up to
+	// this many messages. Zero or one sends every message in its own frame.
+	BatchSize int
+	// BatchInterval flushes a partial batch at least this often (default
+	// 50ms when batching).
+	BatchInterval time.Duration
+	// QueueSize > 0 gives each connection a bounded outbound queue drained
+	// by its own writer goroutine, so Send never writes on the caller's
+	// goroutine. Zero writes synchronously.
+	QueueSize int
+	// OverflowPolicy decides what Send does when a queue is full (default
+	// DropNewest).
+	OverflowPolicy OverflowPolicy
+	// QueueTimeout bounds how long Send waits for room under the Block
+	// policy (default 50ms).
+	QueueTimeout time.Duration
+	// EnableCompression offers permessage-deflate and the "compression"
+	// capability; writes are compressed only if the server accepts both.
+	EnableCompression bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.URL == "" {
+		c.URL = defaultWSURL
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = defaultPoolSize
+	}
+	if c.PoolSize > maxPoolSize {
+		c.PoolSize = maxPoolSize
+	}
+	if c.RequestTimeout <= 0 {
+		c.RequestTimeout = requestTimeout
+	}
+	if c.ReconnectDelay <= 0 {
+		c.ReconnectDelay = reconnectDelay
+	}
+	if c.MaxReconnectDelay <= 0 {
+		c.MaxReconnectDelay = maxReconnectDelay
+	}
+	if c.MaxReconnectDelay < c.ReconnectDelay {
+		c.MaxReconnectDelay = c.ReconnectDelay
+	}
+	if c.PingPeriod <= 0 {
+		c.PingPeriod = pingPeriod
+	}
+	if c.PongWait <= 0 {
+		c.PongWait = pongWait
+	}
+	if c.WriteWait <= 0 {
+		c.WriteWait = writeWait
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = handshakeTimeout
+	}
+	if c.HelloTimeout <= 0 {
+		c.HelloTimeout = helloTimeout
+	}
+	if c.HelloTimeout > c.RequestTimeout {
+		c.HelloTimeout = c.RequestTimeout
+	}
+	if c.Proxy == nil {
+		c.Proxy = http.ProxyFromEnvironment
+	}
+	if c.Logger == nil {
+		c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if c.BatchSize > 1 && c.BatchInterval <= 0 {
+		c.BatchInterval = defaultBatchInterval
+	}
+	if c.QueueSize > 0 && c.QueueTimeout <= 0 {
+		c.QueueTimeout = defaultQueueTimeout
+	}
+	return c
+}
+
+// ErrClosed is returned once the manager has been closed.
+var ErrClosed = errors.New("socket manager closed")
+
+var errNotConnected = errors.New("WebSocket not connected")
+
+// ConnectionState is the lifecycle state of one pooled connection.
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// MarshalText encodes the state as its name.
+func (s ConnectionState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 // PooledConnection represents a single WebSocket connection in the pool
 type PooledConnection struct {
 	ws              *websocket.Conn
@@ -34,6 +198,11 @@ type PooledConnection struct {
 	index           int
 	mu              sync.RWMutex
 	messageHandlers map[string]chan *UsageFlowSocketResponse
+	// outbound is set when Config.QueueSize > 0.
+	outbound *outboundQueue
+	// negotiated is set while the connection counts toward
+	// UsageFlowSocketManager.negotiatedConns.
+	negotiated bool
 }
 
 // UsageFlowSocketManager manages a pool of WebSocket connections to UsageFlow
@@ -45,24 +214,72 @@ type UsageFlowSocketManager struct {
 	connecting      bool
 	connectionMutex sync.Mutex
 	apiKey          string
+	config          Config
 	mu              sync.RWMutex
+	// closed stops reconnects once Close is called; done wakes background
+	// goroutines (pings, supervisors) so they exit.
+	closed    atomic.Bool
+	closeOnce sync.Once
+	done      chan struct{}
+	// slots holds the per-index reconnect state; one supervisor goroutine
+	// per slot redials it whenever its connection drops.
+	slots         []*connectionSlot
+	superviseOnce sync.Once
+	listeners     stateListeners
+	pushes        pushListeners
+	undelivered   undeliveredListeners
+	batch         batcher
+	queue         queueCounters
+	// server is what the latest hello handshake negotiated, and
+	// negotiatedConns how many live connections completed one.
+	server          atomic.Pointer[ServerInfo]
+	negotiatedConns atomic.Int32
+	// logLimit rate-limits per-message log events.
+	logLimit logging.Limiter
+	// alertLogger is Config.Logger, or slog.Default when none was set, for
+	// errors that must not be discarded.
+	alertLogger *slog.Logger
+}
+
+// connectionSlot tracks one pool index across reconnects.
+type connectionSlot struct {
+	mu        sync.Mutex
+	state     ConnectionState
+	since     time.Time
+	attempt   int
+	lastError error
+	wake      chan struct{}
 }
 
 // NewUsageFlowSocketManager creates a new WebSocket manager instance
 func NewUsageFlowSocketManager(apiKey string, poolSize ...int) *UsageFlowSocketManager {
-	size := defaultPoolSize
-	if len(poolSize) > 0 && poolSize[0] > 0 {
-		size = poolSize[0]
-	}
-	if size > maxPoolSize {
-		size = maxPoolSize
+	var cfg Config
+	if len(poolSize) > 0 {
+		cfg.PoolSize = poolSize[0]
 	}
+	return NewUsageFlowSocketManagerWithConfig(apiKey, cfg)
+}
 
+// NewUsageFlowSocketManagerWithConfig creates a WebSocket manager using cfg
+// for the endpoint, pool size, timeouts and dialer.
+func NewUsageFlowSocketManagerWithConfig(apiKey string, cfg Config) *UsageFlowSocketManager {
+	alertLogger := cfg.Logger
+	if alertLogger == nil {
+		alertLogger = slog.Default()
+	}
+	cfg = cfg.withDefaults()
 	socket := &UsageFlowSocketManager{
 		connections: make([]*PooledConnection, 0),
-		wsURL:       defaultWSURL,
-		poolSize:    size,
+		wsURL:       cfg.URL,
+		poolSize:    cfg.PoolSize,
 		apiKey:      apiKey,
+		config:      cfg,
+		done:        make(chan struct{}),
+		alertLogger: alertLogger,
+	}
+
+	if cfg.OnStateChange != nil {
+		socket.OnStateChange(cfg.OnStateChange)
 	}
 
 	// Tests / local offline mode: skip dialing so suites don't hang on reconnect loops.
@@ -74,29 +291,74 @@ func NewUsageFlowSocketManager(apiKey string, poolSize ...int) *UsageFlowSocketM
 	return socket
 }
 
-// Connect establishes all WebSocket connections in the pool
+// Connect establishes all WebSocket connections in the pool. It returns
+// ErrIncompatibleProtocol when the server's protocol version rules this
+// agent out; those slots are not redialed.
 func (m *UsageFlowSocketManager) Connect() error {
 	if m.apiKey == "" {
 		return errors.New("API key not available")
 	}
+	if m.closed.Load() {
+		return ErrClosed
+	}
 
+	// State changes are delivered after connectionMutex is released, so
+	// listeners may call back into the manager.
+	events, failed := m.connectPool()
+	for _, event := range events {
+		m.emit(event)
+	}
+	// Retry failed connections in background
+	var incompatible error
+	for _, f := range failed {
+		if errors.Is(f.err, ErrIncompatibleProtocol) {
+			// Redialing cannot fix a version mismatch.
+			m.setSlotState(f.index, StateDisconnected, f.err)
+			incompatible = f.err
+			continue
+		}
+		m.markDown(f.index, f.err)
+	}
+
+	return incompatible
+}
+
+// slotFailure is a pool slot whose first dial failed.
+type slotFailure struct {
+	index int
+	err   error
+}
+
+// connectPool dials the pool under connectionMutex. It returns the slot
+// state changes for the caller to emit and the slots left to redial.
+func (m *UsageFlowSocketManager) connectPool() ([]ConnectionEvent, []slotFailure) {
 	m.connectionMutex.Lock()
 	defer m.connectionMutex.Unlock()
 
 	if m.connecting {
 		// Wait for existing connection attempts
-		return nil
+		return nil, nil
 	}
 
 	if len(m.connections) > 0 && m.IsConnected() {
 		// Already connected
-		return nil
+		return nil, nil
+	}
+
+	// After the first dial, the supervisors own redials; just make sure
+	// every dropped slot is being retried.
+	if m.slot(0) != nil {
+		for i := 0; i < m.poolSize; i++ {
+			m.wakeSlot(i)
+		}
+		return nil, nil
 	}
 
 	m.connecting = true
 	defer func() {
 		m.connecting = false
 	}()
+	m.startSupervisors()
 
 	// Create all connections in parallel
 	type connResult struct {
@@ -107,7 +369,11 @@ func (m *UsageFlowSocketManager) Connect() error {
 
 	results := make(chan connResult, m.poolSize)
 
+	var events []ConnectionEvent
 	for i := 0; i < m.poolSize; i++ {
+		if event, ok := m.updateSlot(i, StateConnecting, nil); ok {
+			events = append(events, event)
+		}
 		go func(index int) {
 			conn, err := m.createConnection(index)
 			results <- connResult{conn: conn, index: index, err: err}
@@ -116,12 +382,12 @@ func (m *UsageFlowSocketManager) Connect() error {
 
 	// Collect results
 	successful := make([]*PooledConnection, 0, m.poolSize)
-	failed := make([]int, 0)
+	var failed []slotFailure
 
 	for i := 0; i < m.poolSize; i++ {
 		result := <-results
 		if result.err != nil {
-			failed = append(failed, result.index)
+			failed = append(failed, slotFailure{result.index, result.err})
 		} else {
 			successful = append(successful, result.conn)
 		}
@@ -140,15 +406,17 @@ func (m *UsageFlowSocketManager) Connect() error {
 	m.connections = successful
 	m.mu.Unlock()
 
-	// Retry failed connections in background
-	for _, index := range failed {
-		go func(idx int) {
-			time.Sleep(reconnectDelay)
-			m.reconnectConnectionWithRetry(idx, 0)
-		}(index)
+	for _, conn := range successful {
+		if event, ok := m.updateSlot(conn.index, StateConnected, nil); ok {
+			events = append(events, event)
+		}
+		// A connection that dropped before it was published was not
+		// current, so its reader could not mark the slot down.
+		if !conn.isConnected() {
+			failed = append(failed, slotFailure{conn.index, errNotConnected})
+		}
 	}
-
-	return nil
+	return events, failed
 }
 
 // createConnection creates a single WebSocket connection
@@ -157,17 +425,34 @@ func (m *UsageFlowSocketManager) createConnection(index int) (*PooledConnection,
 		return nil, errors.New("API key not available")
 	}
 
-	headers := make(map[string][]string)
+	headers := m.config.Header.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	for key := range headers {
+		if strings.EqualFold(key, "x-usage-key") {
+			delete(headers, key)
+		}
+	}
 	headers["x-usage-key"] = []string{m.apiKey}
 
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
+	dialer := m.config.Dialer
+	if dialer == nil {
+		dialer = &websocket.Dialer{
+			HandshakeTimeout:  m.config.HandshakeTimeout,
+			Proxy:             m.config.Proxy,
+			TLSClientConfig:   m.config.TLSConfig,
+			EnableCompression: m.config.EnableCompression,
+		}
 	}
 
 	conn, _, err := dialer.Dial(m.wsURL, headers)
 	if err != nil {
+		m.config.Logger.Warn("usageflow: websocket dial failed", "pool_index", index, "url", m.wsURL, "error", err)
 		return nil, fmt.Errorf("failed to dial WebSocket: %w", err)
 	}
+	// Compress only once the hello confirms the server wants it.
+	conn.EnableWriteCompression(false)
 
 	pooledConn := &PooledConnection{
 		ws:              conn,
@@ -180,12 +465,16 @@ func (m *UsageFlowSocketManager) createConnection(index int) (*PooledConnection,
 	// Set pong handler to extend read deadline on pong
 	conn.SetPongHandler(func(string) error {
 		// Extend read deadline when pong is received
-		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetReadDeadline(time.Now().Add(m.config.PongWait))
 		return nil
 	})
 
 	// Set initial read deadline
-	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetReadDeadline(time.Now().Add(m.config.PongWait))
+
+	if m.queueing() {
+		m.startWriter(pooledConn)
+	}
 
 	// Start message handler goroutine
 	go m.handleMessages(pooledConn)
@@ -199,38 +488,47 @@ func (m *UsageFlowSocketManager) createConnection(index int) (*PooledConnection,
 		pooledConn.connected = false
 		pooledConn.mu.Unlock()
 
-		// Attempt to reconnect after a delay
-		go func() {
-			time.Sleep(reconnectDelay)
-			if m.apiKey != "" {
-				m.reconnectConnectionWithRetry(index, 0)
-			}
-		}()
+		// Hand the slot to its supervisor for a redial
+		if m.isCurrent(pooledConn) {
+			m.markDown(index, &websocket.CloseError{Code: code, Text: text})
+		}
 
 		return nil
 	})
 
+	if err := m.hello(pooledConn); err != nil {
+		pooledConn.close()
+		pooledConn.stopWriter()
+		return nil, err
+	}
+
 	return pooledConn, nil
 }
 
 // handleMessages processes incoming messages for a connection
 func (m *UsageFlowSocketManager) handleMessages(conn *PooledConnection) {
+	var readErr error
 	defer func() {
 		conn.mu.Lock()
 		conn.connected = false
+		if conn.negotiated {
+			conn.negotiated = false
+			m.negotiatedConns.Add(-1)
+		}
 		// Clear all pending handlers on disconnect
 		for id := range conn.messageHandlers {
 			delete(conn.messageHandlers, id)
 		}
 		conn.mu.Unlock()
+		conn.stopWriter()
 
 		// Trigger reconnection when read fails (server restart, network issue, etc.)
-		go func() {
-			time.Sleep(reconnectDelay)
-			if m.apiKey != "" {
-				m.reconnectConnectionWithRetry(conn.index, 0)
+		if m.isCurrent(conn) {
+			if readErr != nil && !m.closed.Load() {
+				m.logLimit.Log(context.Background(), m.config.Logger, slog.LevelWarn, "usageflow: websocket connection lost", "pool_index", conn.index, "error", readErr)
 			}
-		}()
+			m.markDown(conn.index, readErr)
+		}
 	}()
 
 	for {
@@ -245,6 +543,7 @@ func (m *UsageFlowSocketManager) handleMessages(conn *PooledConnection) {
 		// Read message
 		_, message, err := ws.ReadMessage()
 		if err != nil {
+			readErr = err
 			// Check if it's a timeout - this means pong wasn't received
 			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
 				// Read deadline expired - connection is likely dead
@@ -260,10 +559,11 @@ func (m *UsageFlowSocketManager) handleMessages(conn *PooledConnection) {
 		}
 
 		// Extend read deadline after successful read (connection is alive)
-		ws.SetReadDeadline(time.Now().Add(pongWait))
+		ws.SetReadDeadline(time.Now().Add(m.config.PongWait))
 
 		var response UsageFlowSocketResponse
 		if err := json.Unmarshal(message, &response); err != nil {
+			m.logLimit.Log(context.Background(), m.config.Logger, slog.LevelWarn, "usageflow: discarding undecodable message", "pool_index", conn.index, "error", err)
 			continue
 		}
 
@@ -291,71 +591,215 @@ func (m *UsageFlowSocketManager) handleMessages(conn *PooledConnection) {
 			case handler <- &response:
 			default:
 			}
+		} else if response.Type != "" {
+			// Unsolicited server message (e.g. config invalidation)
+			m.emitPush(&response)
 		}
 	}
 }
 
-// reconnectConnection attempts to reconnect a specific connection
-func (m *UsageFlowSocketManager) reconnectConnection(index int) {
-	m.reconnectConnectionWithRetry(index, 0)
+// startSupervisors allocates the per-slot state and starts one supervisor
+// goroutine per pool index.
+func (m *UsageFlowSocketManager) startSupervisors() {
+	m.superviseOnce.Do(func() {
+		m.mu.Lock()
+		m.slots = make([]*connectionSlot, m.poolSize)
+		for i := range m.slots {
+			m.slots[i] = &connectionSlot{wake: make(chan struct{}, 1)}
+		}
+		m.mu.Unlock()
+		for i := range m.slots {
+			go m.supervise(i)
+		}
+	})
+}
+
+func (m *UsageFlowSocketManager) slot(index int) *connectionSlot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if index < 0 || index >= len(m.slots) {
+		return nil
+	}
+	return m.slots[index]
 }
 
-// reconnectConnectionWithRetry attempts to reconnect with exponential backoff
-func (m *UsageFlowSocketManager) reconnectConnectionWithRetry(index int, attempt int) {
-	if attempt >= maxReconnectTries {
-		// Max retries reached, give up for now
-		// Will retry on next connection attempt
+func (m *UsageFlowSocketManager) setSlotState(index int, state ConnectionState, err error) {
+	if event, ok := m.updateSlot(index, state, err); ok {
+		m.emit(event)
+	}
+}
+
+// updateSlot records the state of the slot at index and returns the event
+// to emit, if the state changed.
+func (m *UsageFlowSocketManager) updateSlot(index int, state ConnectionState, err error) (ConnectionEvent, bool) {
+	slot := m.slot(index)
+	if slot == nil {
+		return ConnectionEvent{}, false
+	}
+	slot.mu.Lock()
+	old := slot.state
+	if old != state {
+		slot.since = time.Now()
+	}
+	slot.state = state
+	slot.lastError = err
+	if state == StateConnected {
+		slot.attempt = 0
+	}
+	slot.mu.Unlock()
+
+	if old == state {
+		return ConnectionEvent{}, false
+	}
+	return ConnectionEvent{
+		Index:   index,
+		Old:     old,
+		New:     state,
+		Err:     err,
+		Healthy: m.healthyConnections(),
+	}, true
+}
+
+// markDown records that the connection at index dropped and wakes its
+// supervisor.
+func (m *UsageFlowSocketManager) markDown(index int, err error) {
+	if m.closed.Load() {
 		return
 	}
+	slot := m.slot(index)
+	if slot == nil {
+		return
+	}
+	m.setSlotState(index, StateDisconnected, err)
+	m.wakeSlot(index)
+}
 
-	m.connectionMutex.Lock()
-	defer m.connectionMutex.Unlock()
+// wakeSlot asks the supervisor of index to redial if it is not connected.
+func (m *UsageFlowSocketManager) wakeSlot(index int) {
+	slot := m.slot(index)
+	if slot == nil {
+		return
+	}
+	select {
+	case slot.wake <- struct{}{}:
+	default:
+	}
+}
 
+// isCurrent reports whether conn is still the pooled connection for its
+// index, so events from replaced connections don't trigger redials.
+func (m *UsageFlowSocketManager) isCurrent(conn *PooledConnection) bool {
 	m.mu.RLock()
-	var existingConn *PooledConnection
+	defer m.mu.RUnlock()
+	for _, c := range m.connections {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// slotConnected reports whether the pool holds a live connection for index.
+func (m *UsageFlowSocketManager) slotConnected(index int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	for _, conn := range m.connections {
-		if conn.index == index {
-			existingConn = conn
-			break
+		if conn.index == index && conn.isConnected() {
+			return true
 		}
 	}
-	m.mu.RUnlock()
+	return false
+}
 
-	if existingConn != nil {
-		existingConn.mu.Lock()
-		if existingConn.ws != nil {
-			existingConn.ws.Close()
+// supervise redials the connection at index each time it drops, retrying
+// forever with jittered exponential backoff until the manager is closed or
+// the server turns out to be incompatible.
+// Backoff restarts from ReconnectDelay after every successful connection.
+func (m *UsageFlowSocketManager) supervise(index int) {
+	slot := m.slot(index)
+	for {
+		select {
+		case <-slot.wake:
+		case <-m.done:
+			return
 		}
-		existingConn.connected = false
-		// Clear all pending handlers
-		for id := range existingConn.messageHandlers {
-			delete(existingConn.messageHandlers, id)
+
+		for {
+			// The slot state alone can be stale: a connection that drops
+			// while it is being published never marks the slot down.
+			live := m.slotConnected(index)
+			slot.mu.Lock()
+			if slot.state == StateConnected && live {
+				slot.mu.Unlock()
+				break
+			}
+			attempt := slot.attempt
+			slot.attempt++
+			slot.mu.Unlock()
+
+			timer := time.NewTimer(m.backoff(attempt))
+			select {
+			case <-timer.C:
+			case <-m.done:
+				timer.Stop()
+				return
+			}
+
+			m.setSlotState(index, StateConnecting, nil)
+			if err := m.redial(index); err != nil {
+				m.setSlotState(index, StateDisconnected, err)
+				if errors.Is(err, ErrIncompatibleProtocol) {
+					// Wait for an explicit Connect instead of retrying.
+					break
+				}
+				continue
+			}
+			m.setSlotState(index, StateConnected, nil)
 		}
-		existingConn.mu.Unlock()
+	}
+}
+
+// backoff returns the jittered delay before redial attempt n (0-based): the
+// base delay doubles per attempt up to MaxReconnectDelay, and the result is
+// drawn uniformly from [d/2, d).
+func (m *UsageFlowSocketManager) backoff(attempt int) time.Duration {
+	d := m.config.ReconnectDelay
+	for i := 0; i < attempt && d < m.config.MaxReconnectDelay; i++ {
+		d *= 2
+	}
+	if d > m.config.MaxReconnectDelay {
+		d = m.config.MaxReconnectDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + mathrand.N(half)
+}
+
+// redial replaces the connection at index with a freshly dialed one.
+func (m *UsageFlowSocketManager) redial(index int) error {
+	if m.closed.Load() {
+		return ErrClosed
 	}
 
-	// Create new connection
 	newConn, err := m.createConnection(index)
 	if err != nil {
-		// Retry with exponential backoff
-		backoff := reconnectDelay * time.Duration(1<<uint(attempt))
-		if backoff > 60*time.Second {
-			backoff = 60 * time.Second
-		}
-		go func() {
-			time.Sleep(backoff)
-			if m.apiKey != "" {
-				m.reconnectConnectionWithRetry(index, attempt+1)
-			}
-		}()
-		return
+		return err
+	}
+	if m.closed.Load() {
+		// Close raced with the dial; don't resurrect the pool.
+		newConn.close()
+		return ErrClosed
 	}
 
 	m.mu.Lock()
 	// Replace or add the connection
+	var old *PooledConnection
 	found := false
 	for i, conn := range m.connections {
 		if conn.index == index {
+			old = conn
 			m.connections[i] = newConn
 			found = true
 			break
@@ -365,21 +809,40 @@ func (m *UsageFlowSocketManager) reconnectConnectionWithRetry(index int, attempt
 		m.connections = append(m.connections, newConn)
 	}
 	m.mu.Unlock()
+
+	if old != nil {
+		old.mu.Lock()
+		if old.ws != nil {
+			old.ws.Close()
+		}
+		old.connected = false
+		// Clear all pending handlers
+		for id := range old.messageHandlers {
+			delete(old.messageHandlers, id)
+		}
+		old.mu.Unlock()
+	}
+	return nil
 }
 
 // pingConnection sends periodic ping messages to keep the connection alive.
 // Writes must hold conn.mu — gorilla/websocket forbids concurrent writers.
 func (m *UsageFlowSocketManager) pingConnection(conn *PooledConnection) {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(m.config.PingPeriod)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
 		conn.mu.Lock()
 		if !conn.connected || conn.ws == nil {
 			conn.mu.Unlock()
 			return
 		}
-		conn.ws.SetWriteDeadline(time.Now().Add(writeWait))
+		conn.ws.SetWriteDeadline(time.Now().Add(m.config.WriteWait))
 		err := conn.ws.WriteMessage(websocket.PingMessage, nil)
 		if err != nil {
 			conn.connected = false
@@ -446,38 +909,71 @@ func (m *UsageFlowSocketManager) getConnection() *PooledConnection {
 
 // SendAsync sends a message and waits for a response
 func (m *UsageFlowSocketManager) SendAsync(payload *UsageFlowSocketMessage) (*UsageFlowSocketResponse, error) {
+	return m.SendAsyncContext(context.Background(), payload)
+}
+
+// SendAsyncContext sends a message and waits for a response until the
+// request timeout elapses or ctx is done, whichever comes first.
+func (m *UsageFlowSocketManager) SendAsyncContext(ctx context.Context, payload *UsageFlowSocketMessage) (*UsageFlowSocketResponse, error) {
 	conn := m.getConnection()
 	if conn == nil {
 		return nil, errors.New("WebSocket not connected")
 	}
 
-	return m.asyncSend(payload, conn)
+	return m.asyncSend(ctx, payload, conn)
 }
 
-// Send sends a message without waiting for a response
+// Send sends a message without waiting for a response. With batching
+// enabled (Config.BatchSize > 1) the message is queued and written as part
+// of the next batch frame. With an outbound queue (Config.QueueSize > 0)
+// Send only enqueues the frame and returns ErrQueueFull on overflow.
 func (m *UsageFlowSocketManager) Send(payload *UsageFlowSocketMessage) error {
-	conn := m.getConnection()
-	if conn == nil {
-		return errors.New("WebSocket not connected")
+	if m.batching() {
+		return m.enqueue(payload)
 	}
+	return m.writeFrame(payload)
+}
 
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
+// SendDirect writes payload as its own frame on the caller's goroutine,
+// bypassing batching and the outbound queue, and returns the write error.
+// Use it when the caller must know the message left the process, e.g.
+// before discarding a spooled copy.
+func (m *UsageFlowSocketManager) SendDirect(payload *UsageFlowSocketMessage) error {
+	return m.write(payload, false)
+}
 
-	if !conn.connected || conn.ws == nil {
-		return errors.New("WebSocket not connected")
+// writeFrame writes payload as a single frame on the next pooled connection,
+// or hands it to that connection's outbound queue.
+func (m *UsageFlowSocketManager) writeFrame(payload *UsageFlowSocketMessage) error {
+	return m.write(payload, true)
+}
+
+func (m *UsageFlowSocketManager) write(payload *UsageFlowSocketMessage, queue bool) error {
+	conn := m.getConnection()
+	if conn == nil {
+		return errNotConnected
 	}
 
 	messageBytes, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
+	if queue && conn.outbound != nil {
+		return m.push(conn, queuedFrame{data: messageBytes, msgs: frameMessages(payload)})
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if !conn.connected || conn.ws == nil {
+		return errNotConnected
+	}
 
 	return conn.ws.WriteMessage(websocket.TextMessage, messageBytes)
 }
 
 // asyncSend sends a message and waits for a response with timeout
-func (m *UsageFlowSocketManager) asyncSend(payload *UsageFlowSocketMessage, conn *PooledConnection) (*UsageFlowSocketResponse, error) {
+func (m *UsageFlowSocketManager) asyncSend(ctx context.Context, payload *UsageFlowSocketMessage, conn *PooledConnection) (*UsageFlowSocketResponse, error) {
 	conn.mu.Lock()
 	if !conn.connected || conn.ws == nil {
 		conn.mu.Unlock()
@@ -534,7 +1030,10 @@ func (m *UsageFlowSocketManager) asyncSend(payload *UsageFlowSocketMessage, conn
 	case response := <-responseChan:
 		cleanup()
 		return response, nil
-	case <-time.After(requestTimeout):
+	case <-ctx.Done():
+		cleanup()
+		return nil, ctx.Err()
+	case <-time.After(m.config.RequestTimeout):
 		cleanup()
 
 		return nil, errors.New("WebSocket request timeout")
@@ -580,20 +1079,54 @@ func (m *UsageFlowSocketManager) IsConnected() bool {
 	return false
 }
 
-// Close closes all WebSocket connections
+// Close closes all WebSocket connections and stops background pings and
+// reconnects. A closed manager does not reconnect.
 func (m *UsageFlowSocketManager) Close() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.closeOnce.Do(func() {
+		m.closed.Store(true)
+		m.stopBatcher()
+		if m.done != nil {
+			close(m.done)
+		}
+		// Let the batcher and the queue writers write what is queued
+		// before the pool goes away.
+		m.drainBatcher()
+		m.mu.RLock()
+		for _, conn := range m.connections {
+			conn.stopWriter()
+		}
+		m.mu.RUnlock()
+		m.queue.writers.Wait()
+	})
 
+	m.mu.Lock()
 	for _, conn := range m.connections {
-		conn.mu.Lock()
-		if conn.ws != nil {
-			conn.ws.Close()
-		}
-		conn.connected = false
-		conn.mu.Unlock()
+		conn.close()
 	}
 	m.connections = make([]*PooledConnection, 0)
+	slots := len(m.slots)
+	m.mu.Unlock()
+
+	for i := 0; i < slots; i++ {
+		m.setSlotState(i, StateDisconnected, ErrClosed)
+	}
+}
+
+// isConnected reports whether the connection is still up.
+func (c *PooledConnection) isConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+// close marks the connection down and closes the underlying socket.
+func (c *PooledConnection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws != nil {
+		c.ws.Close()
+	}
+	c.connected = false
 }
 
 // Destroy cleans up all resources
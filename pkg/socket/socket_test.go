@@ -1,14 +1,24 @@
 package socket
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewUsageFlowSocketManager(t *testing.T) {
@@ -255,5 +265,598 @@ func TestConstants(t *testing.T) {
 	assert.Equal(t, 30*time.Second, pingPeriod)
 	assert.Equal(t, 60*time.Second, pongWait)
 	assert.Equal(t, 10*time.Second, writeWait)
-	assert.Equal(t, 5, maxReconnectTries)
+	assert.Equal(t, 60*time.Second, maxReconnectDelay)
+}
+
+func TestConfig_WithDefaults(t *testing.T) {
+	cfg := Config{PoolSize: 50}.withDefaults()
+	assert.Equal(t, defaultWSURL, cfg.URL)
+	assert.Equal(t, maxPoolSize, cfg.PoolSize)
+	assert.Equal(t, requestTimeout, cfg.RequestTimeout)
+	assert.Equal(t, reconnectDelay, cfg.ReconnectDelay)
+	assert.Equal(t, maxReconnectDelay, cfg.MaxReconnectDelay)
+	assert.Equal(t, pingPeriod, cfg.PingPeriod)
+	assert.Equal(t, pongWait, cfg.PongWait)
+	assert.Equal(t, writeWait, cfg.WriteWait)
+	assert.NotNil(t, cfg.Logger)
+
+	custom := Config{URL: "ws://localhost:1/ws", RequestTimeout: time.Second}.withDefaults()
+	assert.Equal(t, "ws://localhost:1/ws", custom.URL)
+	assert.Equal(t, time.Second, custom.RequestTimeout)
+}
+
+func TestNewUsageFlowSocketManagerWithConfig_LocalServer(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	keys := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("x-usage-key")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			_ = conn.WriteJSON(UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID, Payload: map[string]interface{}{"echo": msg.Type}})
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:            "ws" + server.URL[4:],
+		PoolSize:       1,
+		RequestTimeout: time.Second,
+	})
+	defer manager.Close()
+
+	assert.Equal(t, "test-key", <-keys)
+	assert.True(t, manager.IsConnected())
+
+	response, err := manager.SendAsync(&UsageFlowSocketMessage{Type: "ping_test"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"echo": "ping_test"}, response.Payload)
+	}
+}
+
+func TestUsageFlowSocketManager_CloseStopsReconnects(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var dials atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dials.Add(1)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:            "ws" + server.URL[4:],
+		PoolSize:       1,
+		ReconnectDelay: 10 * time.Millisecond,
+	})
+	assert.True(t, manager.IsConnected())
+
+	manager.Close()
+	assert.False(t, manager.IsConnected())
+	assert.Error(t, manager.Connect())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), dials.Load(), "closed manager must not redial")
+}
+
+func TestUsageFlowSocketManager_SendAsyncContext_Canceled(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+			received <- struct{}{}
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:            "ws" + server.URL[4:],
+		PoolSize:       1,
+		RequestTimeout: 5 * time.Second,
+	})
+	defer manager.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := manager.SendAsyncContext(ctx, &UsageFlowSocketMessage{Type: "request_for_allocation"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+
+	conn := manager.getConnection()
+	conn.mu.Lock()
+	assert.Empty(t, conn.messageHandlers)
+	assert.Zero(t, conn.pendingRequests)
+	conn.mu.Unlock()
+}
+
+func TestUsageFlowSocketManager_Backoff(t *testing.T) {
+	m := &UsageFlowSocketManager{config: Config{ReconnectDelay: 100 * time.Millisecond, MaxReconnectDelay: time.Second}.withDefaults()}
+
+	for i := 0; i < 50; i++ {
+		first := m.backoff(0)
+		assert.GreaterOrEqual(t, first, 50*time.Millisecond)
+		assert.Less(t, first, 100*time.Millisecond)
+
+		capped := m.backoff(30)
+		assert.GreaterOrEqual(t, capped, 500*time.Millisecond)
+		assert.Less(t, capped, time.Second)
+	}
+}
+
+func TestUsageFlowSocketManager_SupervisorRetriesPastOldLimit(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var attempts atomic.Int32
+	serverConns := make(chan *websocket.Conn, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reject more upgrades than the old five-try limit allowed.
+		if attempts.Add(1) <= 8 {
+			http.Error(w, "upgrade blocked", http.StatusBadGateway)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:               "ws" + server.URL[4:],
+		PoolSize:          1,
+		ReconnectDelay:    2 * time.Millisecond,
+		MaxReconnectDelay: 10 * time.Millisecond,
+	})
+	defer manager.Close()
+
+	assert.False(t, manager.IsConnected())
+	assert.Eventually(t, manager.IsConnected, 5*time.Second, 5*time.Millisecond)
+
+	slot := manager.slot(0)
+	slot.mu.Lock()
+	assert.Equal(t, StateConnected, slot.state)
+	assert.Zero(t, slot.attempt, "backoff resets after a successful connection")
+	slot.mu.Unlock()
+
+	// A later drop is redialed as well.
+	first := <-serverConns
+	before := attempts.Load()
+	first.Close()
+	assert.Eventually(t, func() bool {
+		return attempts.Load() > before && manager.IsConnected()
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestUsageFlowSocketManager_RedialsDropDuringPoolDial(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var dials atomic.Int32
+	firstClosed := make(chan struct{})
+	secondHello := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := dials.Add(1)
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			switch {
+			case n == 1 && msg.Type == MessageTypeHello:
+				// Drop the first connection while the second is still
+				// handshaking.
+				answerHello(conn, msg)
+				<-secondHello
+				conn.Close()
+				time.Sleep(20 * time.Millisecond)
+				close(firstClosed)
+				return
+			case n == 2 && msg.Type == MessageTypeHello:
+				close(secondHello)
+				<-firstClosed
+				answerHello(conn, msg)
+			default:
+				answerHello(conn, msg)
+			}
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:               "ws" + server.URL[4:],
+		PoolSize:          2,
+		HelloTimeout:      time.Second,
+		ReconnectDelay:    2 * time.Millisecond,
+		MaxReconnectDelay: 10 * time.Millisecond,
+	})
+	defer manager.Close()
+
+	assert.Eventually(t, func() bool {
+		return dials.Load() >= 3 && manager.HealthyConnections() == 2
+	}, 5*time.Second, 5*time.Millisecond, "the slot that dropped mid-dial is redialed")
+}
+
+func TestUsageFlowSocketManager_OnStateChange(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	serverConns := make(chan *websocket.Conn, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+		}
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var events []ConnectionEvent
+	record := func(e ConnectionEvent) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	snapshot := func() []ConnectionEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]ConnectionEvent(nil), events...)
+	}
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:               "ws" + server.URL[4:],
+		PoolSize:          2,
+		ReconnectDelay:    2 * time.Millisecond,
+		MaxReconnectDelay: 10 * time.Millisecond,
+		OnStateChange:     record,
+	})
+
+	initial := snapshot()
+	require.Len(t, initial, 4, "each slot reports connecting then connected")
+	connected := 0
+	for _, e := range initial {
+		if e.New == StateConnected {
+			connected++
+			assert.Equal(t, StateConnecting, e.Old)
+		}
+	}
+	assert.Equal(t, 2, connected)
+	slots := manager.Slots()
+	require.Len(t, slots, 2)
+	for i, slot := range slots {
+		assert.Equal(t, i, slot.Index)
+		assert.Equal(t, StateConnected, slot.State)
+		assert.False(t, slot.Since.IsZero())
+		assert.Empty(t, slot.LastError)
+	}
+
+	// Drop one connection from the server side.
+	(<-serverConns).Close()
+	assert.Eventually(t, func() bool {
+		for _, e := range snapshot()[4:] {
+			if e.New == StateConnected {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 5*time.Millisecond)
+
+	var drop *ConnectionEvent
+	for _, e := range snapshot()[4:] {
+		if e.Old == StateConnected && e.New == StateDisconnected {
+			e := e
+			drop = &e
+			break
+		}
+	}
+	if assert.NotNil(t, drop) {
+		assert.Error(t, drop.Err)
+		assert.Equal(t, 1, drop.Healthy)
+	}
+
+	before := len(snapshot())
+	manager.Close()
+	closing := snapshot()[before:]
+	require.Len(t, closing, 2)
+	for _, e := range closing {
+		assert.Equal(t, StateDisconnected, e.New)
+		assert.ErrorIs(t, e.Err, ErrClosed)
+	}
+	assert.Equal(t, 0, closing[1].Healthy)
+	for _, slot := range manager.Slots() {
+		assert.Equal(t, StateDisconnected, slot.State)
+		assert.Equal(t, ErrClosed.Error(), slot.LastError)
+	}
+}
+
+func TestUsageFlowSocketManager_OnStateChangeUnsubscribe(t *testing.T) {
+	manager := &UsageFlowSocketManager{poolSize: 1, config: Config{}.withDefaults(), done: make(chan struct{})}
+	manager.startSupervisors()
+	defer manager.Close()
+
+	calls := 0
+	unsubscribe := manager.OnStateChange(func(ConnectionEvent) { calls++ })
+	manager.setSlotState(0, StateConnecting, nil)
+	unsubscribe()
+	manager.setSlotState(0, StateConnected, nil)
+	assert.Equal(t, 1, calls)
+}
+
+func TestUsageFlowSocketManager_OnStateChangeListenerCallsBack(t *testing.T) {
+	manager := &UsageFlowSocketManager{poolSize: 1, config: Config{}.withDefaults(), done: make(chan struct{})}
+	manager.startSupervisors()
+
+	var unsubscribe func()
+	unsubscribe = manager.OnStateChange(func(e ConnectionEvent) {
+		unsubscribe()
+		manager.OnStateChange(func(ConnectionEvent) {})
+		manager.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		manager.setSlotState(0, StateConnected, nil)
+		manager.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener calling back into the manager deadlocked")
+	}
+	assert.Equal(t, StateDisconnected, manager.Slots()[0].State)
+}
+
+func TestUsageFlowSocketManager_OnPush(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg, CapabilityPushConfig) {
+				continue
+			}
+			_ = conn.WriteJSON(UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID})
+			_ = conn.WriteJSON(UsageFlowSocketResponse{Type: "config_updated"})
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{URL: "ws" + server.URL[4:], PoolSize: 1})
+	defer manager.Close()
+
+	pushes := make(chan string, 4)
+	unsubscribe := manager.OnPush(func(msg *UsageFlowSocketResponse) { pushes <- msg.Type })
+	defer unsubscribe()
+
+	response, err := manager.SendAsync(&UsageFlowSocketMessage{Type: "ping_test"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", response.Type, "replies are not treated as pushes")
+
+	select {
+	case got := <-pushes:
+		assert.Equal(t, "config_updated", got)
+	case <-time.After(2 * time.Second):
+		t.Fatal("push not delivered")
+	}
+}
+
+func TestUsageFlowSocketManager_OnPushUnsubscribeFromHandler(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg, CapabilityPushConfig) {
+				continue
+			}
+			_ = conn.WriteJSON(UsageFlowSocketResponse{Type: "config_updated"})
+			_ = conn.WriteJSON(UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID})
+		}
+	}))
+	defer server.Close()
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:            "ws" + server.URL[4:],
+		PoolSize:       1,
+		RequestTimeout: time.Second,
+	})
+	defer manager.Close()
+
+	pushes := 0
+	var unsubscribe func()
+	unsubscribe = manager.OnPush(func(*UsageFlowSocketResponse) {
+		pushes++
+		unsubscribe()
+	})
+
+	for i := 0; i < 2; i++ {
+		response, err := manager.SendAsync(&UsageFlowSocketMessage{Type: "ping_test"})
+		require.NoError(t, err, "the reader must keep running after the handler unsubscribes")
+		assert.Equal(t, "success", response.Type)
+	}
+	assert.Equal(t, 1, pushes)
+}
+
+func TestUsageFlowSocketManager_TLSAndHeaders(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	headers := make(chan http.Header, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+		}
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:       "wss" + server.URL[5:],
+		PoolSize:  1,
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Header:    http.Header{"X-Tenant": {"acme"}, "x-usage-key": {"spoofed"}},
+	})
+	defer manager.Close()
+
+	require.True(t, manager.IsConnected(), "private CA is trusted")
+	got := <-headers
+	assert.Equal(t, "acme", got.Get("X-Tenant"))
+	assert.Equal(t, []string{"test-key"}, got.Values("x-usage-key"))
+}
+
+func TestUsageFlowSocketManager_AuthenticatedProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg UsageFlowSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if answerHello(conn, msg) {
+				continue
+			}
+		}
+	}))
+	defer backend.Close()
+
+	auth := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Proxy-Authorization")
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_, _ = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(upstream, client)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(client, upstream)
+		client.Close()
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	proxyURL.User = url.UserPassword("agent", "s3cret")
+
+	manager := NewUsageFlowSocketManagerWithConfig("test-key", Config{
+		URL:      "ws" + backend.URL[4:],
+		PoolSize: 1,
+		Proxy:    http.ProxyURL(proxyURL),
+	})
+	defer manager.Close()
+
+	require.True(t, manager.IsConnected())
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("agent:s3cret")), <-auth)
+}
+
+// answerHello replies to the agent's handshake like a current server and
+// reports whether msg was the hello.
+func answerHello(conn *websocket.Conn, msg UsageFlowSocketMessage, capabilities ...string) bool {
+	if msg.Type != MessageTypeHello {
+		return false
+	}
+	_ = conn.WriteJSON(UsageFlowSocketResponse{
+		Type:    MessageTypeHello,
+		ReplyTo: msg.ID,
+		Payload: HelloResponse{ProtocolVersion: ProtocolVersion, Capabilities: capabilities},
+	})
+	return true
 }
@@ -0,0 +1,330 @@
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpoolMaxBytes = 64 << 20
+	defaultSpoolMaxAge   = 24 * time.Hour
+	spoolSuffix          = ".spool"
+)
+
+// ErrSpoolFull is returned by Spool.Append when the size cap is reached.
+var ErrSpoolFull = errors.New("spool is full")
+
+// ErrSpoolClosed is returned by Spool.Append after Close.
+var ErrSpoolClosed = errors.New("spool is closed")
+
+// SpoolConfig configures the on-disk metering spool. Zero values fall back to
+// the package defaults.
+type SpoolConfig struct {
+	// Dir holds the spool segments. It is created if missing.
+	Dir string
+	// MaxBytes caps the total size of all segments (default 64 MiB). Appends
+	// beyond it fail with ErrSpoolFull.
+	MaxBytes int64
+	// MaxAge discards entries older than this at replay (default 24h).
+	MaxAge time.Duration
+	// Logger receives spool diagnostics; nil discards them.
+	Logger *slog.Logger
+}
+
+func (c SpoolConfig) withDefaults() SpoolConfig {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultSpoolMaxBytes
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = defaultSpoolMaxAge
+	}
+	if c.Logger == nil {
+		c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return c
+}
+
+// Spool is an append-only, on-disk queue of messages that could not be
+// delivered. Entries are stored as JSON lines in numbered segment files so
+// they survive process restarts and replay in the order they were written.
+type Spool struct {
+	config   SpoolConfig
+	mu       sync.Mutex
+	replayMu sync.Mutex
+	active   *os.File
+	closed   bool
+	seq      uint64
+	size     int64
+	count    int
+}
+
+type spoolEntry struct {
+	Time    int64           `json:"ts"`
+	Message json.RawMessage `json:"msg"`
+}
+
+// OpenSpool opens (or creates) the spool in cfg.Dir, picking up segments
+// left by a previous process.
+func OpenSpool(cfg SpoolConfig) (*Spool, error) {
+	cfg = cfg.withDefaults()
+	if cfg.Dir == "" {
+		return nil, errors.New("spool directory is required")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{config: cfg}
+	segments, err := s.segments(^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		info, err := os.Stat(seg.path)
+		if err != nil {
+			continue
+		}
+		s.size += info.Size()
+		s.count += countLines(seg.path)
+		if seg.seq >= s.seq {
+			s.seq = seg.seq + 1
+		}
+	}
+	return s, nil
+}
+
+// Append writes msg to the active segment.
+func (s *Spool) Append(msg *UsageFlowSocketMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	line, err := json.Marshal(spoolEntry{Time: time.Now().UnixNano(), Message: raw})
+	if err != nil {
+		return fmt.Errorf("failed to marshal spool entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+	if s.size+int64(len(line)) > s.config.MaxBytes {
+		return ErrSpoolFull
+	}
+	if s.active == nil {
+		f, err := os.OpenFile(s.segmentPath(s.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open spool segment: %w", err)
+		}
+		s.active = f
+		s.seq++
+	}
+	if _, err := s.active.Write(line); err != nil {
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	s.size += int64(len(line))
+	s.count++
+	return nil
+}
+
+// Len reports the number of spooled entries not yet replayed.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Replay sends spooled entries in write order, deleting them as they are
+// delivered. Entries older than MaxAge are discarded. Replay stops at the
+// first send error and keeps the remaining entries for the next call. It
+// returns the number of entries sent.
+func (s *Spool) Replay(send func(*UsageFlowSocketMessage) error) (int, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	// Seal the active segment so new appends go to a fresh one and the
+	// segments replayed here are immutable.
+	s.mu.Lock()
+	if s.active != nil {
+		_ = s.active.Close()
+		s.active = nil
+	}
+	limit := s.seq
+	s.mu.Unlock()
+
+	segments, err := s.segments(limit)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, seg := range segments {
+		n, err := s.replaySegment(seg.path, send)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+func (s *Spool) replaySegment(path string, send func(*UsageFlowSocketMessage) error) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+
+	sent := 0
+	cutoff := time.Now().Add(-s.config.MaxAge).UnixNano()
+	rest := data
+	for len(rest) > 0 {
+		line := rest
+		next := len(rest)
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i]
+			next = i + 1
+		}
+
+		if len(line) == 0 {
+			rest = rest[next:]
+			s.consumed(int64(next), false)
+			continue
+		}
+
+		var entry spoolEntry
+		var msg UsageFlowSocketMessage
+		if err := json.Unmarshal(line, &entry); err != nil || json.Unmarshal(entry.Message, &msg) != nil {
+			s.config.Logger.Warn("usageflow: skipping corrupt spool entry", "segment", filepath.Base(path))
+		} else if entry.Time < cutoff {
+			s.config.Logger.Warn("usageflow: discarding expired spool entry", "type", msg.Type, "age", time.Since(time.Unix(0, entry.Time)))
+		} else {
+			msg.Payload = rawPayload(entry.Message)
+			if err := send(&msg); err != nil {
+				return sent, s.truncateSegment(path, data, rest, err)
+			}
+			sent++
+		}
+		rest = rest[next:]
+		s.consumed(int64(next), true)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return sent, fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+	return sent, nil
+}
+
+// truncateSegment rewrites path to hold only the unsent tail and returns
+// cause so the caller stops replaying.
+func (s *Spool) truncateSegment(path string, data, rest []byte, cause error) error {
+	if len(rest) == len(data) {
+		return cause
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, rest, 0o600); err != nil {
+		return errors.Join(cause, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Join(cause, err)
+	}
+	return cause
+}
+
+// consumed releases n bytes of the size cap once a line leaves the spool.
+func (s *Spool) consumed(n int64, entry bool) {
+	s.mu.Lock()
+	s.size -= n
+	if entry && s.count > 0 {
+		s.count--
+	}
+	s.mu.Unlock()
+}
+
+// Close closes the active segment; later appends fail with ErrSpoolClosed.
+// Spooled entries stay on disk.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+}
+
+// segments lists segment files with a sequence number below limit, oldest
+// first.
+func (s *Spool) segments(limit uint64) ([]spoolSegment, error) {
+	entries, err := os.ReadDir(s.config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool directory: %w", err)
+	}
+	var segments []spoolSegment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil || seq >= limit {
+			continue
+		}
+		segments = append(segments, spoolSegment{seq: seq, path: filepath.Join(s.config.Dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// rawPayload extracts the undecoded "payload" field of a spooled message so
+// it is resent byte-for-byte.
+func rawPayload(message json.RawMessage) json.RawMessage {
+	var fields struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &fields); err != nil || len(fields.Payload) == 0 {
+		return json.RawMessage("null")
+	}
+	return fields.Payload
+}
+
+func countLines(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,128 @@
+package socket
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spoolTypes(t *testing.T, s *Spool, failAfter int) ([]string, error) {
+	t.Helper()
+	var types []string
+	_, err := s.Replay(func(msg *UsageFlowSocketMessage) error {
+		if failAfter >= 0 && len(types) == failAfter {
+			return errors.New("WebSocket not connected")
+		}
+		types = append(types, msg.Type)
+		return nil
+	})
+	return types, err
+}
+
+func TestSpool_ReplaysInOrderAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(SpoolConfig{Dir: dir})
+	require.NoError(t, err)
+
+	allocationID := "alloc-1"
+	require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "request_for_allocation", Payload: &RequestForAllocation{Alias: "GET /a", Amount: 1, AllocationID: &allocationID}}))
+	require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "use_allocation", Payload: &UseAllocationRequest{Alias: "GET /a", Amount: 1, AllocationID: allocationID}}))
+	require.NoError(t, s.Close())
+
+	// A new process picks up the segment left behind.
+	s, err = OpenSpool(SpoolConfig{Dir: dir})
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "report_call_chain"}))
+
+	var replayed []*UsageFlowSocketMessage
+	sent, err := s.Replay(func(msg *UsageFlowSocketMessage) error {
+		replayed = append(replayed, msg)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, 0, s.Len())
+	require.Len(t, replayed, 3)
+	assert.Equal(t, "request_for_allocation", replayed[0].Type)
+	assert.Equal(t, "use_allocation", replayed[1].Type)
+	assert.Equal(t, "report_call_chain", replayed[2].Type)
+
+	// Payloads are resent byte-for-byte, keeping the original allocation ID.
+	body, err := json.Marshal(replayed[1])
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"allocationId":"alloc-1"`)
+
+	segments, err := s.segments(^uint64(0))
+	require.NoError(t, err)
+	assert.Empty(t, segments)
+}
+
+func TestSpool_ReplayStopsAtFirstFailure(t *testing.T) {
+	s, err := OpenSpool(SpoolConfig{Dir: t.TempDir()})
+	require.NoError(t, err)
+	for _, kind := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: kind}))
+	}
+
+	types, err := spoolTypes(t, s, 1)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a"}, types)
+	assert.Equal(t, 2, s.Len())
+
+	types, err = spoolTypes(t, s, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, types)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSpool_SizeCap(t *testing.T) {
+	s, err := OpenSpool(SpoolConfig{Dir: t.TempDir(), MaxBytes: 200})
+	require.NoError(t, err)
+
+	var appendErr error
+	for i := 0; i < 10 && appendErr == nil; i++ {
+		appendErr = s.Append(&UsageFlowSocketMessage{Type: "use_allocation"})
+	}
+	assert.ErrorIs(t, appendErr, ErrSpoolFull)
+
+	_, err = spoolTypes(t, s, -1)
+	require.NoError(t, err)
+	assert.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "use_allocation"}), "replay frees space")
+}
+
+func TestSpool_DiscardsExpiredEntries(t *testing.T) {
+	s, err := OpenSpool(SpoolConfig{Dir: t.TempDir(), MaxAge: 10 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "old"}))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "fresh"}))
+
+	types, err := spoolTypes(t, s, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fresh"}, types)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestSpool_AppendAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(SpoolConfig{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.Append(&UsageFlowSocketMessage{Type: "use_allocation"}))
+	require.NoError(t, s.Close())
+
+	assert.ErrorIs(t, s.Append(&UsageFlowSocketMessage{Type: "use_allocation"}), ErrSpoolClosed)
+	assert.Equal(t, 1, s.Len())
+	segments, err := s.segments(^uint64(0))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1, "a closed spool must not open a new segment")
+}
+
+func TestOpenSpool_RequiresDir(t *testing.T) {
+	_, err := OpenSpool(SpoolConfig{})
+	assert.Error(t, err)
+}
@@ -1,5 +1,10 @@
 package socket
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // UsageFlowSocketMessage represents a message sent to UsageFlow via WebSocket
 type UsageFlowSocketMessage struct {
 	Type    string      `json:"type"`
@@ -17,6 +22,19 @@ type UsageFlowSocketResponse struct {
 	Error   string      `json:"error,omitempty"`
 }
 
+// DecodePayload decodes the response payload into v, which should be a
+// pointer to one of the payload types in this package.
+func (r *UsageFlowSocketResponse) DecodePayload(v interface{}) error {
+	raw, err := json.Marshal(r.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("failed to decode %s payload: %w", r.Type, err)
+	}
+	return nil
+}
+
 // RequestForAllocation represents the payload for allocation requests
 type RequestForAllocation struct {
 	Alias        string                 `json:"alias"`
@@ -72,4 +90,16 @@ type ReportCallChainPayload struct {
 	CallChain          interface{} `json:"callChain"`
 	Timestamp          string      `json:"timestamp"`
 	UsageflowRequestID string      `json:"usageflowRequestId,omitempty"`
+	// TraceID is the W3C trace ID of the request, when it was traced.
+	TraceID string `json:"traceId,omitempty"`
+}
+
+// MessageTypeBatch is the type of a frame that carries several
+// fire-and-forget messages (see BatchPayload).
+const MessageTypeBatch = "batch"
+
+// BatchPayload is the payload of a "batch" frame. The server processes the
+// messages in order, exactly as if each had been sent in its own frame.
+type BatchPayload struct {
+	Messages []*UsageFlowSocketMessage `json:"messages"`
 }
@@ -0,0 +1,422 @@
+// Package usageflowtest runs an in-process fake of the UsageFlow WebSocket
+// API so applications can test their handlers with the middleware enabled.
+//
+// The server speaks the agent protocol: it answers the hello handshake,
+// serves scriptable policies, application config and blocked endpoints,
+// authorizes or denies rate-limited allocations by alias, and records every
+// message it receives.
+//
+//	field, location := "X-User", "headers"
+//	srv := usageflowtest.NewServer(t)
+//	srv.SetPolicies(config.ApiConfigStrategy{
+//		Method: "GET", Url: "/items", HasRateLimit: true,
+//		IdentityFieldName: &field, IdentityFieldLocation: &location,
+//	})
+//	srv.Limit(usageflowtest.Alias("GET", "/items", "user-x"), 2)
+//	api := srv.NewAgent(t)
+//	// The third GET /items with X-User: user-x now returns 429.
+//
+// Agents must actually dial, so do not set USAGEFLOW_DISABLE_WS=1 in tests
+// that use this package.
+package usageflowtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/middleware"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+// Message types the fake server understands.
+const (
+	typePolicies         = "get_application_policies"
+	typeApplicationCfg   = "get_application_config"
+	typeBlockedEndpoints = "get_blocked_endpoints"
+	typeAllocation       = "request_for_allocation"
+	typeUseAllocation    = "use_allocation"
+)
+
+// DenialError is the error Deny and Limit answer denied allocations with.
+const DenialError = "rate_limit_exceeded"
+
+// Alias formats the ledger alias the middleware uses for a route and an
+// optional identity, e.g. Alias("GET", "/items/:id", "user-x").
+func Alias(method, route, identity string) string {
+	alias := fmt.Sprintf("%s %s", method, route)
+	if identity != "" {
+		alias = fmt.Sprintf("%s %s", alias, identity)
+	}
+	return alias
+}
+
+// AllocationHandler decides a rate-limited allocation. A non-empty return
+// value denies it with that error; the middleware then answers 429.
+type AllocationHandler func(req socket.RequestForAllocation) string
+
+// Server is a fake UsageFlow endpoint backed by httptest.Server.
+type Server struct {
+	// URL is the ws:// address to pass to middleware.WithWebSocketURL.
+	URL string
+
+	http     *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu        sync.Mutex
+	conns     map[*websocket.Conn]*sync.Mutex
+	policies  []config.ApiConfigStrategy
+	appConfig config.ApplicationConfigResponse
+	blocked   []config.BlockedEndpoints
+	limits    map[string]int
+	counts    map[string]int
+	allocate  AllocationHandler
+	messages  []socket.UsageFlowSocketMessage
+	received  chan struct{}
+}
+
+// NewServer starts a fake server and closes it when tb finishes.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+	s := &Server{
+		conns:    make(map[*websocket.Conn]*sync.Mutex),
+		limits:   make(map[string]int),
+		counts:   make(map[string]int),
+		received: make(chan struct{}),
+	}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = "ws" + s.http.URL[len("http"):]
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// NewAgent creates a single-connection agent for the server and waits for
+// its first config fetch, so policies set beforehand apply to the first
+// request. The agent is shut down when tb finishes.
+func (s *Server) NewAgent(tb testing.TB, opts ...middleware.Option) *middleware.UsageFlowAPI {
+	tb.Helper()
+	opts = append([]middleware.Option{
+		middleware.WithWebSocketURL(s.URL),
+		middleware.WithPoolSize(1),
+	}, opts...)
+	api := middleware.NewWithOptions("usageflowtest-key", opts...)
+	tb.Cleanup(func() {
+		_, _ = api.Shutdown(context.Background())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.WaitForConfig(ctx); err != nil {
+		tb.Fatalf("usageflowtest: agent did not load config: %v", err)
+	}
+	if !api.IsConnected() {
+		tb.Fatalf("usageflowtest: agent is not connected (is USAGEFLOW_DISABLE_WS=1 set?)")
+	}
+	return api
+}
+
+// Close disconnects all agents and stops the server.
+func (s *Server) Close() {
+	s.http.CloseClientConnections()
+	s.http.Close()
+}
+
+// SetPolicies replaces the policies served for get_application_policies and
+// notifies connected agents.
+func (s *Server) SetPolicies(policies ...config.ApiConfigStrategy) {
+	s.mu.Lock()
+	s.policies = policies
+	s.mu.Unlock()
+	s.Push("config_updated")
+}
+
+// SetApplicationConfig replaces the config served for
+// get_application_config (monitoring paths, whitelist, plan cap) and
+// notifies connected agents.
+func (s *Server) SetApplicationConfig(cfg config.ApplicationConfigResponse) {
+	s.mu.Lock()
+	s.appConfig = cfg
+	s.mu.Unlock()
+	s.Push("config_updated")
+}
+
+// SetBlockedEndpoints replaces the blocked endpoints and notifies connected
+// agents.
+func (s *Server) SetBlockedEndpoints(endpoints ...config.BlockedEndpoints) {
+	s.mu.Lock()
+	s.blocked = endpoints
+	s.mu.Unlock()
+	s.Push("blocked_endpoints_updated")
+}
+
+// Allow removes any limit on alias.
+func (s *Server) Allow(alias string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.limits, alias)
+}
+
+// Deny denies every rate-limited allocation for alias.
+func (s *Server) Deny(alias string) {
+	s.Limit(alias, 0)
+}
+
+// Limit authorizes the next n rate-limited allocations for alias and denies
+// the rest. Non-rate-limited routes are metered fire-and-forget and are
+// never denied.
+func (s *Server) Limit(alias string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits[alias] = n
+	s.counts[alias] = 0
+}
+
+// SetAllocationHandler decides rate-limited allocations for aliases without
+// a Limit. nil authorizes them. fn runs on the connection's read goroutine.
+func (s *Server) SetAllocationHandler(fn AllocationHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allocate = fn
+}
+
+// Push sends an unsolicited message of msgType (such as "config_updated")
+// to every connected agent.
+func (s *Server) Push(msgType string) {
+	s.mu.Lock()
+	conns := make(map[*websocket.Conn]*sync.Mutex, len(s.conns))
+	for conn, mu := range s.conns {
+		conns[conn] = mu
+	}
+	s.mu.Unlock()
+	for conn, mu := range conns {
+		mu.Lock()
+		_ = conn.WriteJSON(socket.UsageFlowSocketResponse{Type: msgType})
+		mu.Unlock()
+	}
+}
+
+// Messages returns every message received so far, in order, with batch
+// frames expanded. Payloads are json.RawMessage; see Decode.
+func (s *Server) Messages() []socket.UsageFlowSocketMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]socket.UsageFlowSocketMessage(nil), s.messages...)
+}
+
+// MessagesOfType returns the received messages of msgType.
+func (s *Server) MessagesOfType(msgType string) []socket.UsageFlowSocketMessage {
+	var out []socket.UsageFlowSocketMessage
+	for _, msg := range s.Messages() {
+		if msg.Type == msgType {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// Allocations returns the received request_for_allocation payloads.
+func (s *Server) Allocations() []socket.RequestForAllocation {
+	return decodeAll[socket.RequestForAllocation](s.MessagesOfType(typeAllocation))
+}
+
+// Settlements returns the received use_allocation payloads.
+func (s *Server) Settlements() []socket.UseAllocationRequest {
+	return decodeAll[socket.UseAllocationRequest](s.MessagesOfType(typeUseAllocation))
+}
+
+// WaitFor waits until at least n messages of msgType were received and
+// reports whether that happened within timeout. Fire-and-forget metering
+// arrives shortly after the handler returns, so assert on it through
+// WaitFor.
+func (s *Server) WaitFor(msgType string, n int, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		count := 0
+		for _, msg := range s.messages {
+			if msg.Type == msgType {
+				count++
+			}
+		}
+		received := s.received
+		s.mu.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-received:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// Reset forgets recorded messages and allocation counts.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	for alias := range s.counts {
+		s.counts[alias] = 0
+	}
+}
+
+// Decode decodes a recorded message payload into v.
+func Decode(msg socket.UsageFlowSocketMessage, v interface{}) error {
+	raw, ok := msg.Payload.(json.RawMessage)
+	if !ok {
+		return fmt.Errorf("usageflowtest: %s payload is %T, not recorded JSON", msg.Type, msg.Payload)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func decodeAll[T any](messages []socket.UsageFlowSocketMessage) []T {
+	out := make([]T, 0, len(messages))
+	for _, msg := range messages {
+		var v T
+		if Decode(msg, &v) == nil {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// wireMessage keeps the payload undecoded so it can be recorded as sent.
+type wireMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	ID      string          `json:"id,omitempty"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	writeMu := &sync.Mutex{}
+	s.mu.Lock()
+	s.conns[conn] = writeMu
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var msg wireMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == socket.MessageTypeHello {
+			s.reply(conn, writeMu, socket.UsageFlowSocketResponse{
+				Type:    socket.MessageTypeHello,
+				ReplyTo: msg.ID,
+				Payload: socket.HelloResponse{
+					ProtocolVersion: socket.ProtocolVersion,
+					Capabilities:    []string{socket.CapabilityBatch, socket.CapabilityPushConfig},
+				},
+			})
+			continue
+		}
+
+		if msg.Type == socket.MessageTypeBatch {
+			var batch struct {
+				Messages []wireMessage `json:"messages"`
+			}
+			if json.Unmarshal(msg.Payload, &batch) == nil {
+				for _, inner := range batch.Messages {
+					s.record(inner)
+				}
+			}
+			continue
+		}
+
+		s.record(msg)
+		if msg.ID != "" {
+			s.reply(conn, writeMu, s.respond(msg))
+		}
+	}
+}
+
+func (s *Server) record(msg wireMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, socket.UsageFlowSocketMessage{Type: msg.Type, Payload: msg.Payload, ID: msg.ID})
+	close(s.received)
+	s.received = make(chan struct{})
+}
+
+func (s *Server) reply(conn *websocket.Conn, mu *sync.Mutex, response socket.UsageFlowSocketResponse) {
+	mu.Lock()
+	defer mu.Unlock()
+	_ = conn.WriteJSON(response)
+}
+
+// respond builds the reply to a message that expects one.
+func (s *Server) respond(msg wireMessage) socket.UsageFlowSocketResponse {
+	s.mu.Lock()
+	policies, appConfig, blocked := s.policies, s.appConfig, s.blocked
+	s.mu.Unlock()
+
+	response := socket.UsageFlowSocketResponse{Type: "success", ReplyTo: msg.ID}
+	switch msg.Type {
+	case typePolicies:
+		if policies == nil {
+			policies = []config.ApiConfigStrategy{}
+		}
+		response.Payload = config.PolicyListResponse{Policies: policies, Total: len(policies)}
+	case typeApplicationCfg:
+		response.Payload = appConfig
+	case typeBlockedEndpoints:
+		if blocked == nil {
+			blocked = []config.BlockedEndpoints{}
+		}
+		response.Payload = config.BlockedEndpointsResponse{Endpoints: blocked, Total: len(blocked)}
+	case typeAllocation:
+		var req socket.RequestForAllocation
+		_ = json.Unmarshal(msg.Payload, &req)
+		if denial := s.decide(req); denial != "" {
+			return socket.UsageFlowSocketResponse{Type: "error", ReplyTo: msg.ID, Error: denial}
+		}
+		allocationID := uuid.New().String()
+		if req.AllocationID != nil {
+			allocationID = *req.AllocationID
+		}
+		response.Payload = socket.AllocationResponse{AllocationID: allocationID}
+	default:
+		response.Payload = map[string]interface{}{}
+	}
+	return response
+}
+
+// decide applies the alias limit, or else the allocation handler.
+func (s *Server) decide(req socket.RequestForAllocation) string {
+	s.mu.Lock()
+	if limit, ok := s.limits[req.Alias]; ok {
+		s.counts[req.Alias]++
+		denied := s.counts[req.Alias] > limit
+		s.mu.Unlock()
+		if denied {
+			return DenialError
+		}
+		return ""
+	}
+	allocate := s.allocate
+	s.mu.Unlock()
+
+	if allocate != nil {
+		return allocate(req)
+	}
+	return ""
+}
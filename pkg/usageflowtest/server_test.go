@@ -0,0 +1,98 @@
+package usageflowtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/config"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/middleware"
+	"github.com/usageflow/usageflow-go-middleware/v2/pkg/socket"
+)
+
+func itemsHandler(api *middleware.UsageFlowAPI) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	return api.HTTPInterceptor()(mux)
+}
+
+func get(h http.Handler, path, user string) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("X-User", user)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestServer_LimitByAlias(t *testing.T) {
+	field, location := "X-User", "headers"
+	srv := NewServer(t)
+	srv.SetPolicies(config.ApiConfigStrategy{
+		Method:                "GET",
+		Url:                   "/items",
+		HasRateLimit:          true,
+		IdentityFieldName:     &field,
+		IdentityFieldLocation: &location,
+	})
+	srv.Limit(Alias("GET", "/items", "user-x"), 2)
+	handler := itemsHandler(srv.NewAgent(t))
+
+	assert.Equal(t, http.StatusOK, get(handler, "/items", "user-x"))
+	assert.Equal(t, http.StatusOK, get(handler, "/items", "user-x"))
+	assert.Equal(t, http.StatusTooManyRequests, get(handler, "/items", "user-x"), "third call for user-x is denied")
+	assert.Equal(t, http.StatusOK, get(handler, "/items", "user-y"), "other identities are unaffected")
+
+	srv.Allow(Alias("GET", "/items", "user-x"))
+	assert.Equal(t, http.StatusOK, get(handler, "/items", "user-x"))
+
+	allocations := srv.Allocations()
+	require.Len(t, allocations, 5)
+	assert.Equal(t, "GET /items user-x", allocations[0].Alias)
+}
+
+func TestServer_DenyAndAllocationHandler(t *testing.T) {
+	srv := NewServer(t)
+	srv.SetPolicies(config.ApiConfigStrategy{Method: "GET", Url: "/items", HasRateLimit: true})
+	handler := itemsHandler(srv.NewAgent(t))
+
+	srv.Deny(Alias("GET", "/items", ""))
+	assert.Equal(t, http.StatusTooManyRequests, get(handler, "/items", ""))
+
+	srv.Allow(Alias("GET", "/items", ""))
+	calls := 0
+	srv.SetAllocationHandler(func(req socket.RequestForAllocation) string {
+		calls++
+		return ""
+	})
+	assert.Equal(t, http.StatusOK, get(handler, "/items", ""))
+	assert.Equal(t, 1, calls)
+}
+
+func TestServer_RecordsMeteringAndBlocksEndpoints(t *testing.T) {
+	srv := NewServer(t)
+	api := srv.NewAgent(t, middleware.WithBatching(10, 5*time.Millisecond))
+	handler := itemsHandler(api)
+
+	r := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	require.True(t, srv.WaitFor("use_allocation", 1, 2*time.Second), "batched metering is expanded and recorded")
+	require.Len(t, srv.Allocations(), 1)
+	assert.Equal(t, "POST /orders", srv.Allocations()[0].Alias)
+	assert.Equal(t, srv.Settlements()[0].AllocationID, *srv.Allocations()[0].AllocationID)
+
+	srv.SetBlockedEndpoints(config.BlockedEndpoints{Method: "GET", Url: "/items"})
+	assert.Eventually(t, func() bool {
+		return get(handler, "/items", "") == http.StatusForbidden
+	}, 2*time.Second, 10*time.Millisecond, "pushed blocked endpoints apply without waiting for a poll")
+}